@@ -0,0 +1,141 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+type level struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// List filters the clients of a proxy by address, a nil list allows every client
+type List struct {
+	// From the most specific (the proxy) to the global default
+	levels   []*level
+	hasAllow bool
+}
+
+// NewList builds the list from the access configs, ordered from the most specific to the least specific, nil configs are skipped.
+// The first level with an entry matching the client decides, deny entries being checked before allow entries.
+// A client matching no entry is denied when one of the levels has an allow list.
+func NewList(accessConfigs ...*config.AccessConfig) (*List, error) {
+	list := &List{}
+
+	for _, accessConfig := range accessConfigs {
+		if accessConfig == nil {
+			continue
+		}
+
+		allow, err := parseNetworks(accessConfig.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed address: %v", err)
+		}
+
+		deny, err := parseNetworks(accessConfig.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied address: %v", err)
+		}
+
+		list.levels = append(list.levels, &level{allow: allow, deny: deny})
+		list.hasAllow = list.hasAllow || len(allow) > 0
+	}
+
+	return list, nil
+}
+
+// parseNetworks parses cidrs, a single ip is a network of one address
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an ip nor a cidr", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// IsEmpty reports whether the list allows every client
+func (list *List) IsEmpty() bool {
+	return list == nil || len(list.levels) == 0
+}
+
+// Allows reports whether the client is allowed to connect
+func (list *List) Allows(clientAddr net.Addr) bool {
+	if list.IsEmpty() {
+		return true
+	}
+
+	ip := GetIp(clientAddr)
+
+	if ip == nil {
+		return !list.hasAllow
+	}
+
+	for _, level := range list.levels {
+		if containsIp(level.deny, ip) {
+			return false
+		}
+
+		if containsIp(level.allow, ip) {
+			return true
+		}
+	}
+
+	return !list.hasAllow
+}
+
+func containsIp(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetIp returns the ip of the tcp or udp address, or of an address formatted as host:port, nil when there is none
+func GetIp(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+
+		if err != nil {
+			return nil
+		}
+
+		return net.ParseIP(host)
+	}
+}
@@ -0,0 +1,108 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+// stringAddr is an address only known by its string, like the addresses read from a proxy protocol header
+type stringAddr string
+
+func (addr stringAddr) Network() string { return "tcp" }
+func (addr stringAddr) String() string  { return string(addr) }
+
+func TestGetIp(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     net.Addr
+		expected string
+	}{
+		{name: "tcp", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, expected: "192.0.2.1"},
+		{name: "udp", addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, expected: "2001:db8::1"},
+		{name: "host and port", addr: stringAddr("192.0.2.1:1234"), expected: "192.0.2.1"},
+		{name: "ipv6 host and port", addr: stringAddr("[2001:db8::1]:1234"), expected: "2001:db8::1"},
+		{name: "no port", addr: stringAddr("192.0.2.1")},
+		{name: "not an ip", addr: stringAddr("pipe:1234")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip := GetIp(test.addr)
+
+			if test.expected == "" {
+				if ip != nil {
+					t.Errorf("expected no ip, got %s", ip)
+				}
+				return
+			}
+
+			if !ip.Equal(net.ParseIP(test.expected)) {
+				t.Errorf("expected %s, got %s", test.expected, ip)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name string
+		// From the most specific to the least specific
+		accessConfigs []*config.AccessConfig
+		clientAddr    string
+		expected      bool
+	}{
+		{name: "no list", clientAddr: "192.0.2.1:1234", expected: true},
+		{name: "allowed cidr", accessConfigs: []*config.AccessConfig{{Allow: []string{"192.0.2.0/24"}}}, clientAddr: "192.0.2.1:1234", expected: true},
+		{name: "outside allowed cidr", accessConfigs: []*config.AccessConfig{{Allow: []string{"192.0.2.0/24"}}}, clientAddr: "198.51.100.1:1234"},
+		{name: "allowed single ip", accessConfigs: []*config.AccessConfig{{Allow: []string{"2001:db8::1"}}}, clientAddr: "[2001:db8::1]:1234", expected: true},
+		{name: "denied cidr", accessConfigs: []*config.AccessConfig{{Deny: []string{"192.0.2.0/24"}}}, clientAddr: "192.0.2.1:1234"},
+		{name: "outside denied cidr", accessConfigs: []*config.AccessConfig{{Deny: []string{"192.0.2.0/24"}}}, clientAddr: "198.51.100.1:1234", expected: true},
+		{
+			name:          "deny checked before allow",
+			accessConfigs: []*config.AccessConfig{{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.1"}}},
+			clientAddr:    "192.0.2.1:1234",
+		},
+		{
+			name:          "specific allow overrides default deny",
+			accessConfigs: []*config.AccessConfig{{Allow: []string{"192.0.2.1"}}, {Deny: []string{"192.0.2.0/24"}}},
+			clientAddr:    "192.0.2.1:1234",
+			expected:      true,
+		},
+		{
+			name:          "specific deny overrides default allow",
+			accessConfigs: []*config.AccessConfig{{Deny: []string{"192.0.2.1"}}, {Allow: []string{"192.0.2.0/24"}}},
+			clientAddr:    "192.0.2.1:1234",
+		},
+		{
+			name:          "default allow list applies to unmatched clients",
+			accessConfigs: []*config.AccessConfig{{Deny: []string{"192.0.2.1"}}, {Allow: []string{"192.0.2.0/24"}}},
+			clientAddr:    "198.51.100.1:1234",
+		},
+		{name: "no ip with an allow list", accessConfigs: []*config.AccessConfig{{Allow: []string{"192.0.2.0/24"}}}, clientAddr: "pipe"},
+		{name: "no ip with a deny list", accessConfigs: []*config.AccessConfig{{Deny: []string{"192.0.2.0/24"}}}, clientAddr: "pipe", expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, err := NewList(test.accessConfigs...)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if allowed := list.Allows(stringAddr(test.clientAddr)); allowed != test.expected {
+				t.Errorf("expected the client to be allowed: %t, got %t", test.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestNewListInvalidEntry(t *testing.T) {
+	for _, entry := range []string{"192.0.2", "192.0.2.0/33", "example.com"} {
+		if _, err := NewList(&config.AccessConfig{Allow: []string{entry}}); err == nil {
+			t.Errorf("expected %s to be rejected", entry)
+		}
+	}
+}
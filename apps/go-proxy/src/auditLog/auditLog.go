@@ -0,0 +1,242 @@
+package auditLog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const pruneInterval = 24 * time.Hour
+
+const (
+	TypeWake        = "wake"
+	TypeStarted     = "started"
+	TypeWakeFailed  = "wakeFailed"
+	TypeSleep       = "sleep"
+	TypeStopped     = "stopped"
+	TypeSleepFailed = "sleepFailed"
+	// Wake refused in a force sleep window, sleep refused by the pre sleep hook, the state did not change
+	TypeWakeRefused  = "wakeRefused"
+	TypeSleepRefused = "sleepRefused"
+	// State changed without a wake or a sleep, the host was found awake or asleep by the ping
+	TypeStateChange = "stateChange"
+)
+
+// Entry is a state change of a host, with what triggered it
+type Entry struct {
+	Date time.Time `json:"date"`
+	Host string    `json:"host"`
+	Type string    `json:"type"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	// Kind of the reason, with its detail: the proxy, the dependent host or the error
+	Reason       string `json:"reason"`
+	ReasonDetail string `json:"reasonDetail,omitempty"`
+	ProxyName    string `json:"proxyName,omitempty"`
+	ClientAddr   string `json:"clientAddr,omitempty"`
+	// Why the wake or the sleep was refused
+	Refusal string `json:"refusal,omitempty"`
+}
+
+var (
+	entries  []*Entry
+	loadOnce sync.Once
+	mutex    sync.Mutex
+)
+
+func load() {
+	entries = []*Entry{}
+
+	file, err := os.Open(config.Config.AuditLogPath)
+
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Infof("No audit log found at %s, starting a new one", config.Config.AuditLogPath)
+	} else if err != nil {
+		logger.Errorf("Failed to read audit log: %v", err)
+	} else {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			entry := &Entry{}
+
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				logger.Errorf("Skipping invalid audit log line: %v", err)
+				continue
+			}
+
+			entries = append(entries, entry)
+		}
+
+		if err := scanner.Err(); err != nil {
+			logger.Errorf("Failed to read audit log: %v", err)
+		}
+	}
+
+	if err := prune(); err != nil {
+		logger.Errorf("Failed to prune audit log: %v", err)
+	}
+
+	go pruneLoop()
+}
+
+func pruneLoop() {
+	for range time.Tick(pruneInterval) {
+		mutex.Lock()
+		err := prune()
+		mutex.Unlock()
+
+		if err != nil {
+			logger.Errorf("Failed to prune audit log: %v", err)
+		}
+	}
+}
+
+// prune removes the entries older than the retention and rewrites the file when some were removed, the mutex must be held
+func prune() error {
+	limit := time.Now().Add(-config.Config.AuditRetention)
+	kept := []*Entry{}
+
+	for _, entry := range entries {
+		if entry.Date.After(limit) {
+			kept = append(kept, entry)
+		}
+	}
+
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	entries = kept
+
+	data := bytes.Buffer{}
+	encoder := json.NewEncoder(&data)
+
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return config.WriteFileAtomic(config.Config.AuditLogPath, data.Bytes())
+}
+
+// NewEntry returns the entry of a state change of the host
+func NewEntry(hostName string, event hostState.Event) *Entry {
+	entry := &Entry{
+		Date:         event.Date,
+		Host:         hostName,
+		Type:         getEntryType(event),
+		From:         event.From.String(),
+		To:           event.To.String(),
+		Reason:       event.Reason.Kind.String(),
+		ReasonDetail: event.Reason.Source,
+	}
+
+	if event.Reason.Kind == hostState.ReasonProxy {
+		entry.ProxyName = event.Reason.Source
+		entry.ClientAddr = event.Reason.ClientAddr
+	}
+
+	return entry
+}
+
+// NewRefusedEntry returns the entry of a wake or a sleep refused while the host was in the state
+func NewRefusedEntry(hostName string, entryType string, state hostState.State, reason hostState.Reason, refusal error) *Entry {
+	entry := NewEntry(hostName, hostState.Event{From: state, To: state, Reason: reason, Date: time.Now()})
+	entry.Type = entryType
+	entry.Refusal = refusal.Error()
+
+	return entry
+}
+
+func getEntryType(event hostState.Event) string {
+	switch {
+	case event.To == hostState.Starting:
+		return TypeWake
+	case event.From == hostState.Starting && event.To == hostState.Started:
+		return TypeStarted
+	case event.From == hostState.Starting && event.To == hostState.Stopped:
+		return TypeWakeFailed
+	case event.To == hostState.Stopping:
+		return TypeSleep
+	case event.From == hostState.Stopping && event.To == hostState.Stopped:
+		return TypeStopped
+	case event.From == hostState.Stopping && event.To == hostState.Started:
+		return TypeSleepFailed
+	default:
+		return TypeStateChange
+	}
+}
+
+// Record appends the entry to the log
+func Record(entry *Entry) {
+	loadOnce.Do(load)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	entries = append(entries, entry)
+
+	if err := appendToFile(entry); err != nil {
+		logger.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+func appendToFile(entry *Entry) error {
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	filePath := config.Config.AuditLogPath
+
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+
+	return err
+}
+
+// GetHistory returns the entries of the host since the date, oldest first
+func GetHistory(hostName string, since time.Time) []*Entry {
+	loadOnce.Do(load)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	history := []*Entry{}
+
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Host, hostName) && !entry.Date.Before(since) {
+			entryCopy := *entry
+			history = append(history, &entryCopy)
+		}
+	}
+
+	return history
+}
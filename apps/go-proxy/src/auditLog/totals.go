@@ -0,0 +1,96 @@
+package auditLog
+
+import (
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const dateFormat = "2006-01-02"
+
+// DayTotals is the time a host spent awake and asleep during a day, in local time
+type DayTotals struct {
+	Date         string  `json:"date"`
+	UpSeconds    float64 `json:"upSeconds"`
+	SleepSeconds float64 `json:"sleepSeconds"`
+	Wakes        int     `json:"wakes"`
+	Sleeps       int     `json:"sleeps"`
+}
+
+// GetDailyTotals returns the totals of the host for each day from the day of since until now.
+// The time before the first entry of the host is unknown and not counted
+func GetDailyTotals(hostName string, since time.Time, now time.Time) []*DayTotals {
+	history := GetHistory(hostName, time.Time{})
+
+	days := []*DayTotals{}
+	totals := make(map[string]*DayTotals)
+
+	for day := startOfDay(since); !day.After(now); day = day.AddDate(0, 0, 1) {
+		dayTotals := &DayTotals{Date: day.Format(dateFormat)}
+		days = append(days, dayTotals)
+		totals[dayTotals.Date] = dayTotals
+	}
+
+	addDuration := func(state string, from time.Time, to time.Time) {
+		if from.Before(since) {
+			from = since
+		}
+
+		for to.After(from) {
+			end := startOfDay(from).AddDate(0, 0, 1)
+			if to.Before(end) {
+				end = to
+			}
+
+			if dayTotals, exists := totals[from.Format(dateFormat)]; exists {
+				if state == hostState.Stopped.String() {
+					dayTotals.SleepSeconds += end.Sub(from).Seconds()
+				} else {
+					dayTotals.UpSeconds += end.Sub(from).Seconds()
+				}
+			}
+
+			from = end
+		}
+	}
+
+	var state string
+	var stateSince time.Time
+
+	for _, entry := range history {
+		// Dates read from the file keep the offset they were written with
+		entryDate := entry.Date.In(since.Location())
+
+		if state != "" {
+			addDuration(state, stateSince, entryDate)
+		}
+
+		state = entry.To
+		stateSince = entryDate
+
+		dayTotals, exists := totals[entryDate.Format(dateFormat)]
+
+		if !exists || entryDate.Before(since) {
+			continue
+		}
+
+		switch entry.Type {
+		case TypeWake:
+			dayTotals.Wakes++
+		case TypeSleep:
+			dayTotals.Sleeps++
+		}
+	}
+
+	if state != "" {
+		addDuration(state, stateSince, now)
+	}
+
+	return days
+}
+
+func startOfDay(date time.Time) time.Time {
+	year, month, day := date.Date()
+
+	return time.Date(year, month, day, 0, 0, 0, 0, date.Location())
+}
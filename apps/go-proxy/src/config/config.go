@@ -1,108 +1,271 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"time"
 
-	"mgarnier11.fr/go/libs/logger"
 	"mgarnier11.fr/go/libs/utils"
 
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
 )
 
-type ProxyConfig struct {
-	ListenPort int    `yaml:"listenPort"`
-	ServerPort int    `yaml:"serverPort"`
-	Protocol   string `yaml:"protocol"`
-	Name       string `yaml:"name"`
-	Key        string
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+type ProbeConfig struct {
+	// Type is one of tcp, http or command, tcp probes default to the server port of the proxy
+	Type    string `yaml:"type"`
+	Port    int    `yaml:"port,omitempty"`
+	Url     string `yaml:"url,omitempty"`
+	Status  int    `yaml:"status,omitempty"`
+	Command string `yaml:"command,omitempty"`
 }
 
-type HostConfig struct {
-	Proxies      []*ProxyConfig `yaml:"proxies"`
-	Name         string         `yaml:"name"`
-	Ip           string         `yaml:"ip"`
-	MacAddress   string         `yaml:"macAddress"`
-	SSHUsername  string         `yaml:"sshUsername"`
-	SSHPort      string         `yaml:"sshPort"`
-	Autostop     bool           `yaml:"autostop"`
-	MaxAliveTime int            `yaml:"maxAliveTime"`
+type PassiveConfig struct {
+	// Responders answering without waking the host, only minecraft is available
+	Responders     []string `yaml:"responders,omitempty"`
+	Motd           string   `yaml:"motd,omitempty"`
+	IgnoreCidrs    []string `yaml:"ignoreCidrs,omitempty"`
+	IgnorePatterns []string `yaml:"ignorePatterns,omitempty"`
+}
 
-	appConfig *AppConfigFile
+type ActivityConfig struct {
+	// Ignore the traffic of the proxy, it never resets the inactivity timeout
+	Ignore bool `yaml:"ignore,omitempty"`
+	// Bytes sent by the clients within a minute before the traffic counts as activity
+	MinBytesPerMinute int `yaml:"minBytesPerMinute,omitempty"`
+	// Count an open connection as activity, even without traffic
+	OpenConnections bool     `yaml:"openConnections,omitempty"`
+	ExcludeCidrs    []string `yaml:"excludeCidrs,omitempty"`
 }
 
-func (hostConfig *HostConfig) Save() {
-	hostConfig.appConfig.Save()
+// AccessConfig filters the clients by address, entries are ips or cidrs
+type AccessConfig struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
 }
 
-type AppConfigFile struct {
-	ProxyHosts []*HostConfig `yaml:"proxyHosts"`
+// LimitsConfig caps the connections (or udp sessions) and the bandwidth of a proxy, zero values are unlimited
+type LimitsConfig struct {
+	MaxConnections          int     `yaml:"maxConnections,omitempty"`
+	MaxConnectionsPerClient int     `yaml:"maxConnectionsPerClient,omitempty"`
+	ConnectionsPerSecond    float64 `yaml:"connectionsPerSecond,omitempty"`
+	// Bandwidth shared by the connections of the proxy, upload is from the clients to the server
+	UploadBytesPerSecond   int `yaml:"uploadBytesPerSecond,omitempty"`
+	DownloadBytesPerSecond int `yaml:"downloadBytesPerSecond,omitempty"`
 }
 
-func (config *AppConfigFile) unmarshalYaml(yamlString string) error {
-	err := yaml.Unmarshal([]byte(yamlString), config)
-	if err != nil {
-		return err
-	}
+type ProxyConfig struct {
+	ListenPort        int             `yaml:"listenPort"`
+	ServerPort        int             `yaml:"serverPort"`
+	Protocol          string          `yaml:"protocol"`
+	Name              string          `yaml:"name"`
+	Http              bool            `yaml:"http,omitempty"`
+	UDPSessionTimeout int             `yaml:"udpSessionTimeout,omitempty"`
+	ReadinessProbe    *ProbeConfig    `yaml:"readinessProbe,omitempty"`
+	ReadinessTimeout  int             `yaml:"readinessTimeout,omitempty"`
+	Passive           *PassiveConfig  `yaml:"passive,omitempty"`
+	Activity          *ActivityConfig `yaml:"activity,omitempty"`
+	Access            *AccessConfig   `yaml:"access,omitempty"`
+	// Proxy protocol version (v1 or v2) sent to the server before the client data, tcp only
+	SendProxyProtocol string `yaml:"sendProxyProtocol,omitempty"`
+	// Expect a proxy protocol header from the clients, for a proxy behind a load balancer, tcp only
+	AcceptProxyProtocol bool `yaml:"acceptProxyProtocol,omitempty"`
+	// Addresses or cidrs of the load balancers allowed to send the proxy protocol header, required with acceptProxyProtocol
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// Tls server names and http hosts routed to the proxy, a *.domain entry matches every subdomain. Tcp proxies having
+	// hostnames share their listen port, the clients are routed before waking the host
+	Hostnames []string      `yaml:"hostnames,omitempty"`
+	Limits    *LimitsConfig `yaml:"limits,omitempty"`
+	Key       string        `yaml:"-"`
+}
 
-	for _, hostConfig := range config.ProxyHosts {
-		hostConfig.appConfig = config
+// RequiresRestart reports whether the running proxy must be recreated to apply the other config, the access list is
+// the only setting replaced while the proxy runs
+func (proxyConfig *ProxyConfig) RequiresRestart(other *ProxyConfig) bool {
+	current, next := *proxyConfig, *other
+	current.Access, next.Access = nil, nil
+
+	return !reflect.DeepEqual(current, next)
+}
+
+// GetProxyKey returns the key identifying a proxy on its host, udp proxies are
+// suffixed so that a tcp and an udp proxy can share the same port
+func GetProxyKey(name string, listenPort int, protocol string) string {
+	if protocol == ProtocolUDP {
+		return fmt.Sprintf("%s:%d/%s", name, listenPort, protocol)
 	}
 
-	return nil
+	return fmt.Sprintf("%s:%d", name, listenPort)
+}
 
+type SSHTargetConfig struct {
+	Ip          string `yaml:"ip"`
+	SSHUsername string `yaml:"sshUsername,omitempty"`
+	SSHPort     string `yaml:"sshPort,omitempty"`
 }
 
-func (config *AppConfigFile) Save() {
-	err := saveConfigFile(config, Config.ConfigFilePath)
-	if err != nil {
-		logger.Errorf("Failed to save config file: %s", err)
+type WakeConfig struct {
+	// Type is one of wol (default), relay, http or ssh
+	Type             string            `yaml:"type,omitempty"`
+	BroadcastAddress string            `yaml:"broadcastAddress,omitempty"`
+	Port             int               `yaml:"port,omitempty"`
+	SSH              *SSHTargetConfig  `yaml:"ssh,omitempty"`
+	Command          string            `yaml:"command,omitempty"`
+	Url              string            `yaml:"url,omitempty"`
+	Method           string            `yaml:"method,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	Body             string            `yaml:"body,omitempty"`
+}
+
+type PreSleepHookConfig struct {
+	// Type is command (the command must succeed on the host) or containers (none of the containers must be running)
+	Type       string   `yaml:"type"`
+	Command    string   `yaml:"command,omitempty"`
+	Containers []string `yaml:"containers,omitempty"`
+}
+
+type SleepConfig struct {
+	// Type is one of suspend (default), hibernate, poweroff, ssh or http
+	Type          string                `yaml:"type,omitempty"`
+	Command       string                `yaml:"command,omitempty"`
+	Url           string                `yaml:"url,omitempty"`
+	Method        string                `yaml:"method,omitempty"`
+	Headers       map[string]string     `yaml:"headers,omitempty"`
+	Body          string                `yaml:"body,omitempty"`
+	PreSleepHooks []*PreSleepHookConfig `yaml:"preSleepHooks,omitempty"`
+}
+
+type DriverConfig struct {
+	// Type is machine (default) or simulator, the simulator fakes the machine to run go-proxy without real hosts
+	Type string `yaml:"type,omitempty"`
+	// Seconds taken by the simulated machine to boot and to go to sleep
+	BootDelay  int `yaml:"bootDelay,omitempty"`
+	SleepDelay int `yaml:"sleepDelay,omitempty"`
+	// Probability, between 0 and 1, of the simulated machine ignoring a wake request and of a sleep request failing
+	WakeFailureRate  float64 `yaml:"wakeFailureRate,omitempty"`
+	SleepFailureRate float64 `yaml:"sleepFailureRate,omitempty"`
+	// The simulated machine is asleep when go-proxy starts unless set
+	StartAwake bool `yaml:"startAwake,omitempty"`
+	// Ip the proxies of the simulated machine forward to, 127.0.0.1 by default
+	ServerIp string `yaml:"serverIp,omitempty"`
+}
+
+type ScheduleConfig struct {
+	// Type is keepAwake (autostop is disabled in the window), forceSleep (the host is stopped and not woken in the window,
+	// except by the proxies in ExceptProxies) or wake (the host is woken at At)
+	Type string `yaml:"type"`
+	// Days of the week (mon or monday, tue, ...) the entry applies to, every day when empty
+	Days []string `yaml:"days,omitempty"`
+	// Start and end of the window as HH:MM, a window ending before its start ends on the next day
+	From          string   `yaml:"from,omitempty"`
+	To            string   `yaml:"to,omitempty"`
+	At            string   `yaml:"at,omitempty"`
+	ExceptProxies []string `yaml:"exceptProxies,omitempty"`
+}
+
+type HostConfig struct {
+	Proxies         []*ProxyConfig `yaml:"proxies,omitempty"`
+	Name            string         `yaml:"name"`
+	Ip              string         `yaml:"ip"`
+	MacAddress      string         `yaml:"macAddress,omitempty"`
+	SSHUsername     string         `yaml:"sshUsername"`
+	SSHPort         string         `yaml:"sshPort"`
+	Autostop        bool           `yaml:"autostop,omitempty"`
+	MaxAliveTime    int            `yaml:"maxAliveTime,omitempty"`
+	Wake            *WakeConfig    `yaml:"wake,omitempty"`
+	Sleep           *SleepConfig   `yaml:"sleep,omitempty"`
+	StartTimeout    int            `yaml:"startTimeout,omitempty"`
+	StopTimeout     int            `yaml:"stopTimeout,omitempty"`
+	ReadinessProbes []*ProbeConfig `yaml:"readinessProbes,omitempty"`
+	// Wake the host when go-proxy starts, by default the host is left in its current state
+	WakeOnStartup bool              `yaml:"wakeOnStartup,omitempty"`
+	Schedules     []*ScheduleConfig `yaml:"schedules,omitempty"`
+	// Names of the hosts woken before this one, they are not stopped for inactivity while this host is started
+	DependsOn []string      `yaml:"dependsOn,omitempty"`
+	Access    *AccessConfig `yaml:"access,omitempty"`
+	Driver    *DriverConfig `yaml:"driver,omitempty"`
+	// Access of the config file, applied after the access of the host and of its proxies
+	DefaultAccess *AccessConfig `yaml:"-"`
+}
+
+// GetStartTimeout returns the time allowed for the host to become started, 20 seconds by default
+func (hostConfig *HostConfig) GetStartTimeout() time.Duration {
+	if hostConfig.StartTimeout <= 0 {
+		return 20 * time.Second
 	}
+
+	return time.Duration(hostConfig.StartTimeout) * time.Second
+}
+
+// GetStopTimeout returns the time allowed for the host to become stopped after the sleep request, 20 seconds by default
+func (hostConfig *HostConfig) GetStopTimeout() time.Duration {
+	if hostConfig.StopTimeout <= 0 {
+		return 20 * time.Second
+	}
+
+	return time.Duration(hostConfig.StopTimeout) * time.Second
+}
+
+type AppConfigFile struct {
+	// Default access of every proxy
+	Access     *AccessConfig `yaml:"access,omitempty"`
+	ProxyHosts []*HostConfig `yaml:"proxyHosts"`
 }
 
 type AppEnvConfig struct {
 	ServerPort     int
 	ConfigFilePath string
 	SSHPrivateKey  string
+	StateFilePath  string
+	// Time given to the open connections to end when a proxy is stopped
+	DrainTimeout   time.Duration
+	AuditLogPath   string
+	AuditRetention time.Duration
+	// Every host is simulated, to try go-proxy without real machines
+	DemoMode bool
 }
 
-func readFile(filePath string) []byte {
-	bytes, err := os.ReadFile(filePath)
-	if err != nil {
-		panic(err)
-	}
-
-	return bytes
-}
-
-func parseConfigFile(rawFile []byte) *AppConfigFile {
+// ParseConfigFile parses the yaml config and fills the computed fields, it does not validate the config
+func ParseConfigFile(rawFile []byte) (*AppConfigFile, error) {
 	config := &AppConfigFile{}
 
-	err := config.unmarshalYaml(string(rawFile))
+	err := yaml.Unmarshal(rawFile, config)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	for _, hostConfig := range config.ProxyHosts {
-		for _, proxyConfig := range hostConfig.Proxies {
-			proxyConfig.Key = fmt.Sprintf("%s:%d", proxyConfig.Name, proxyConfig.ListenPort)
+		if hostConfig == nil {
+			return nil, errors.New("proxyHosts contains an empty host")
 		}
-	}
 
-	return config
-}
+		hostConfig.DefaultAccess = config.Access
 
-func saveConfigFile(config *AppConfigFile, filePath string) error {
-	data, err := yaml.Marshal(config)
-	if err != nil {
-		panic(err)
+		for _, proxyConfig := range hostConfig.Proxies {
+			if proxyConfig == nil {
+				return nil, fmt.Errorf("host %s: proxies contains an empty proxy", hostConfig.Name)
+			}
+
+			if proxyConfig.Protocol == "" {
+				proxyConfig.Protocol = ProtocolTCP
+			}
+
+			proxyConfig.Protocol = strings.ToLower(proxyConfig.Protocol)
+			proxyConfig.Key = GetProxyKey(proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.Protocol)
+		}
 	}
 
-	return os.WriteFile(filePath, data, 0644)
+	return config, nil
 }
 
 func getAppConfig() (appConfig *AppEnvConfig) {
@@ -125,30 +288,14 @@ func getAppConfig() (appConfig *AppEnvConfig) {
 		ServerPort:     utils.GetEnv("SERVER_PORT", 8080),
 		ConfigFilePath: utils.GetEnv("CONFIG_FILE_PATH", "config.yaml"),
 		SSHPrivateKey:  utils.GetEnv("SSH_PRIVATE_KEY", ""),
+		StateFilePath:  utils.GetEnv("STATE_FILE_PATH", "state.json"),
+		DrainTimeout:   time.Duration(utils.GetEnv("DRAIN_TIMEOUT", 30)) * time.Second,
+		AuditLogPath:   utils.GetEnv("AUDIT_LOG_PATH", "audit.jsonl"),
+		AuditRetention: time.Duration(utils.GetEnv("AUDIT_RETENTION_DAYS", 90)) * 24 * time.Hour,
+		DemoMode:       utils.GetEnv("DEMO_MODE", false),
 	}
 
 	return appConfig
 }
 
-func SetupConfigListener() chan *AppConfigFile {
-	newConfigFileChan := make(chan *AppConfigFile)
-
-	go func() {
-		// Read and send the initial config file
-		oldYamlFile := readFile(Config.ConfigFilePath)
-		newConfigFileChan <- parseConfigFile(oldYamlFile)
-		for range time.Tick(time.Second * 5) {
-			yamlFile := readFile(Config.ConfigFilePath)
-
-			if string(yamlFile) != string(oldYamlFile) {
-				newConfigFileChan <- parseConfigFile(yamlFile)
-			}
-
-			oldYamlFile = yamlFile
-		}
-	}()
-
-	return newConfigFileChan
-}
-
 var Config *AppEnvConfig = getAppConfig()
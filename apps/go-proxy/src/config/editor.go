@@ -0,0 +1,320 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrHostNotFound  = errors.New("host not found")
+	ErrHostExists    = errors.New("host already exists")
+	ErrProxyNotFound = errors.New("proxy not found")
+	ErrInvalidConfig = errors.New("edited config is invalid")
+
+	// Serializes the edits of the config file
+	editMutex sync.Mutex
+	// Set by SetupConfigListener, the edits producing an invalid config are rejected
+	validateEdit func(config *AppConfigFile) error
+)
+
+// editConfigFile applies the edit to the yaml nodes of the config file, so that the comments and the order of the keys
+// are kept, and atomically replaces the file if the edited config is valid. The listener then reloads it.
+func editConfigFile(edit func(root *yaml.Node) error) error {
+	editMutex.Lock()
+	defer editMutex.Unlock()
+
+	rawFile, err := os.ReadFile(Config.ConfigFilePath)
+
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	document := &yaml.Node{}
+
+	if err := yaml.Unmarshal(rawFile, document); err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	if document.Kind == 0 {
+		document.Kind = yaml.DocumentNode
+		document.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	root := document.Content[0]
+
+	if root.Kind != yaml.MappingNode {
+		return errors.New("config file root is not a mapping")
+	}
+
+	if err := edit(root); err != nil {
+		return err
+	}
+
+	buffer := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(detectIndent(rawFile))
+
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("failed to encode config file: %v", err)
+	}
+
+	encoder.Close()
+
+	config, err := ParseConfigFile(buffer.Bytes())
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if validateEdit != nil {
+		if err := validateEdit(config); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	return WriteFileAtomic(Config.ConfigFilePath, buffer.Bytes())
+}
+
+// detectIndent returns the indentation of the first indented line, 2 by default
+func detectIndent(rawFile []byte) int {
+	for _, line := range strings.Split(string(rawFile), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+
+		if indent := len(line) - len(trimmed); indent >= 2 && trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return indent
+		}
+	}
+
+	return 2
+}
+
+// WriteFileAtomic writes to a temporary file renamed over the file, readers never see a partial file and a crash never truncates it
+func WriteFileAtomic(filePath string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+// AddHost appends the host to the config file
+func AddHost(hostConfig *HostConfig) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		hosts := getOrAddMappingValue(root, "proxyHosts", yaml.SequenceNode)
+
+		if findHost(hosts, hostConfig.Name) >= 0 {
+			return ErrHostExists
+		}
+
+		hostNode := &yaml.Node{}
+
+		if err := hostNode.Encode(hostConfig); err != nil {
+			return err
+		}
+
+		hosts.Content = append(hosts.Content, hostNode)
+
+		return nil
+	})
+}
+
+// RemoveHost removes the host from the config file
+func RemoveHost(hostName string) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		hosts := getMappingValue(root, "proxyHosts")
+		index := findHost(hosts, hostName)
+
+		if index < 0 {
+			return ErrHostNotFound
+		}
+
+		hosts.Content = append(hosts.Content[:index], hosts.Content[index+1:]...)
+
+		return nil
+	})
+}
+
+// SetHostFields sets fields of the host, the other fields and the comments are kept
+func SetHostFields(hostName string, fields map[string]any) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		hostNode, err := getHostNode(root, hostName)
+
+		if err != nil {
+			return err
+		}
+
+		for _, field := range slices.Sorted(maps.Keys(fields)) {
+			valueNode := &yaml.Node{}
+
+			if err := valueNode.Encode(fields[field]); err != nil {
+				return err
+			}
+
+			existing := getMappingValue(hostNode, field)
+
+			if existing == nil {
+				hostNode.Content = append(hostNode.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: field}, valueNode)
+				continue
+			}
+
+			valueNode.HeadComment = existing.HeadComment
+			valueNode.LineComment = existing.LineComment
+			valueNode.FootComment = existing.FootComment
+			*existing = *valueNode
+		}
+
+		return nil
+	})
+}
+
+// AddProxy appends the static proxy to the host
+func AddProxy(hostName string, proxyConfig *ProxyConfig) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		hostNode, err := getHostNode(root, hostName)
+
+		if err != nil {
+			return err
+		}
+
+		proxyNode := &yaml.Node{}
+
+		if err := proxyNode.Encode(proxyConfig); err != nil {
+			return err
+		}
+
+		proxies := getOrAddMappingValue(hostNode, "proxies", yaml.SequenceNode)
+		proxies.Content = append(proxies.Content, proxyNode)
+
+		return nil
+	})
+}
+
+// RemoveProxy removes the static proxy listening on the port with the protocol from the host
+func RemoveProxy(hostName string, listenPort int, protocol string) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		hostNode, err := getHostNode(root, hostName)
+
+		if err != nil {
+			return err
+		}
+
+		proxies := getMappingValue(hostNode, "proxies")
+
+		if proxies == nil {
+			return ErrProxyNotFound
+		}
+
+		for i, proxyNode := range proxies.Content {
+			proxyConfig := &ProxyConfig{}
+
+			if err := proxyNode.Decode(proxyConfig); err != nil {
+				continue
+			}
+
+			if proxyConfig.Protocol == "" {
+				proxyConfig.Protocol = ProtocolTCP
+			}
+
+			if proxyConfig.ListenPort == listenPort && strings.EqualFold(proxyConfig.Protocol, protocol) {
+				proxies.Content = append(proxies.Content[:i], proxies.Content[i+1:]...)
+				return nil
+			}
+		}
+
+		return ErrProxyNotFound
+	})
+}
+
+func getHostNode(root *yaml.Node, hostName string) (*yaml.Node, error) {
+	hosts := getMappingValue(root, "proxyHosts")
+	index := findHost(hosts, hostName)
+
+	if index < 0 {
+		return nil, ErrHostNotFound
+	}
+
+	return hosts.Content[index], nil
+}
+
+// findHost returns the index of the host in the hosts sequence, or -1
+func findHost(hosts *yaml.Node, hostName string) int {
+	if hosts == nil || hosts.Kind != yaml.SequenceNode {
+		return -1
+	}
+
+	for i, hostNode := range hosts.Content {
+		if name := getMappingValue(hostNode, "name"); name != nil && strings.EqualFold(name.Value, hostName) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// getMappingValue returns the value of the key in the mapping node, or nil
+func getMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+func getOrAddMappingValue(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	value := getMappingValue(mapping, key)
+
+	// An empty key is decoded as a null scalar
+	if value != nil && value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+		value.Kind = kind
+		value.Tag = ""
+		value.Value = ""
+	}
+
+	if value == nil {
+		value = &yaml.Node{Kind: kind}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	}
+
+	return value
+}
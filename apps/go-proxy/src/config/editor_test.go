@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const editorFixture = `# Hosts woken by the proxy
+proxyHosts:
+    # Main server
+    - name: server
+      ip: 192.168.1.10 # Static lease
+      sshUsername: admin
+      sshPort: "22"
+      maxAliveTime: 30
+      proxies:
+        # Web ui
+        - name: web
+          listenPort: 8080
+          serverPort: 80
+          protocol: tcp
+        - name: dns
+          listenPort: 5353
+          serverPort: 53
+          protocol: udp
+    # Kept as written
+    - name: backup
+      ip: 192.168.1.11
+      sshUsername: root
+      sshPort: "2222"
+`
+
+const webProxyFixture = `        # Web ui
+        - name: web
+          listenPort: 8080
+          serverPort: 80
+          protocol: tcp
+`
+
+func TestEditConfigFile(t *testing.T) {
+	defer func(appConfig *AppEnvConfig) { Config = appConfig }(Config)
+
+	tests := []struct {
+		name string
+		edit func() error
+		// Pairs of old and new strings replaced in the fixture to get the expected file
+		replacements []string
+		expected     error
+	}{
+		{
+			name: "set host fields",
+			edit: func() error {
+				return SetHostFields("Server", map[string]any{"autostop": true, "maxAliveTime": 10})
+			},
+			// The missing field is appended at the end of the host
+			replacements: []string{
+				"      maxAliveTime: 30\n", "      maxAliveTime: 10\n",
+				"          protocol: udp\n", "          protocol: udp\n      autostop: true\n",
+			},
+		},
+		{
+			name: "add proxy",
+			edit: func() error {
+				return AddProxy("server", &ProxyConfig{Name: "ssh", ListenPort: 2200, ServerPort: 22, Protocol: ProtocolTCP})
+			},
+			replacements: []string{
+				"          protocol: udp\n", "          protocol: udp\n        - listenPort: 2200\n          serverPort: 22\n          protocol: tcp\n          name: ssh\n",
+			},
+		},
+		{
+			name:         "remove proxy",
+			edit:         func() error { return RemoveProxy("server", 8080, "TCP") },
+			replacements: []string{webProxyFixture, ""},
+		},
+		{
+			name:     "unknown host",
+			edit:     func() error { return SetHostFields("unknown", map[string]any{"autostop": true}) },
+			expected: ErrHostNotFound,
+		},
+		{
+			name:     "unknown proxy",
+			edit:     func() error { return RemoveProxy("server", 8080, ProtocolUDP) },
+			expected: ErrProxyNotFound,
+		},
+		{
+			name:     "invalid edit",
+			edit:     func() error { return SetHostFields("server", map[string]any{"maxAliveTime": "soon"}) },
+			expected: ErrInvalidConfig,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Config = &AppEnvConfig{ConfigFilePath: filepath.Join(t.TempDir(), "config.yml")}
+
+			if err := os.WriteFile(Config.ConfigFilePath, []byte(editorFixture), 0644); err != nil {
+				t.Fatalf("failed to write the fixture: %v", err)
+			}
+
+			if err := test.edit(); !errors.Is(err, test.expected) {
+				t.Fatalf("expected the error %v, got %v", test.expected, err)
+			}
+
+			expected := strings.NewReplacer(test.replacements...).Replace(editorFixture)
+			edited, err := os.ReadFile(Config.ConfigFilePath)
+
+			if err != nil {
+				t.Fatalf("failed to read the edited file: %v", err)
+			}
+
+			if string(edited) != expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected, edited)
+			}
+		})
+	}
+}
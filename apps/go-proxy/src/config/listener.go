@@ -0,0 +1,124 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// Editors write files in several steps, the reload waits for the writes to settle
+	configReloadDelay  = 500 * time.Millisecond
+	configPollInterval = 5 * time.Second
+)
+
+// SetupConfigListener sends the config file each time it changes, invalid configs are logged and skipped
+// so that the last valid config keeps running
+func SetupConfigListener(validate func(config *AppConfigFile) error) chan *AppConfigFile {
+	newConfigFileChan := make(chan *AppConfigFile)
+	validateEdit = validate
+
+	go func() {
+		var lastYamlFile []byte
+
+		reload := func() {
+			yamlFile, err := os.ReadFile(Config.ConfigFilePath)
+
+			if err != nil {
+				logger.Errorf("Failed to read config file: %v", err)
+				return
+			}
+
+			if lastYamlFile != nil && bytes.Equal(yamlFile, lastYamlFile) {
+				return
+			}
+
+			lastYamlFile = yamlFile
+
+			config, err := loadConfigFile(yamlFile, validate)
+
+			if err != nil {
+				logger.Errorf("Invalid config file, keeping the last valid config: %v", err)
+				return
+			}
+
+			newConfigFileChan <- config
+		}
+
+		reload()
+
+		err := watchConfigFile(reload)
+
+		logger.Errorf("Failed to watch config file, polling it every %v: %v", configPollInterval, err)
+
+		pollConfigFile(reload)
+	}()
+
+	return newConfigFileChan
+}
+
+func loadConfigFile(yamlFile []byte, validate func(config *AppConfigFile) error) (*AppConfigFile, error) {
+	config, err := ParseConfigFile(yamlFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	if err := validate(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// watchConfigFile calls reload when the config file changes, the directory is watched since editors often replace the file
+func watchConfigFile(reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	configFilePath := filepath.Clean(Config.ConfigFilePath)
+
+	if err := watcher.Add(filepath.Dir(configFilePath)); err != nil {
+		return err
+	}
+
+	var reloadTimer <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+
+			if filepath.Clean(event.Name) == configFilePath && !event.Has(fsnotify.Chmod) {
+				reloadTimer = time.After(configReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+
+			return err
+		case <-reloadTimer:
+			reloadTimer = nil
+			reload()
+		}
+	}
+}
+
+func pollConfigFile(reload func()) {
+	for range time.Tick(configPollInterval) {
+		reload()
+	}
+}
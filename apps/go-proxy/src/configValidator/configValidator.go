@@ -0,0 +1,432 @@
+package configValidator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostDriver"
+	"mgarnier11.fr/go/go-proxy/passive"
+	"mgarnier11.fr/go/go-proxy/power"
+	"mgarnier11.fr/go/go-proxy/probe"
+	"mgarnier11.fr/go/go-proxy/proxyProtocol"
+	"mgarnier11.fr/go/go-proxy/schedule"
+)
+
+// Validate returns every error found in the config, it is empty when the config is valid
+func Validate(configFile *config.AppConfigFile) []error {
+	validator := &validator{
+		hostNames:   make(map[string]bool),
+		listenPorts: make(map[string]string),
+		sharedPorts: make(map[string]*sharedPortUsage),
+	}
+
+	if _, err := acl.NewList(configFile.Access); err != nil {
+		validator.addError("access: %v", err)
+	}
+
+	for i, hostConfig := range configFile.ProxyHosts {
+		validator.validateHost(i, hostConfig)
+	}
+
+	if len(validator.errors) == 0 {
+		validator.validateDependencies(configFile)
+	}
+
+	return validator.errors
+}
+
+// ValidateConfig returns the errors of the config joined, or nil when it is valid
+func ValidateConfig(configFile *config.AppConfigFile) error {
+	return errors.Join(Validate(configFile)...)
+}
+
+type validator struct {
+	errors    []error
+	hostNames map[string]bool
+	// Host and proxy using each listen port, by port and protocol
+	listenPorts map[string]string
+	// Ports shared by the proxies having hostnames, by port and protocol
+	sharedPorts map[string]*sharedPortUsage
+}
+
+type sharedPortUsage struct {
+	acceptProxyProtocol bool
+	trustedProxies      []string
+	// Host and proxy owning each hostname
+	hostnames map[string]string
+}
+
+func (validator *validator) addError(format string, args ...any) {
+	validator.errors = append(validator.errors, fmt.Errorf(format, args...))
+}
+
+func (validator *validator) validateHost(index int, hostConfig *config.HostConfig) {
+	hostName := hostConfig.Name
+
+	if hostName == "" {
+		hostName = fmt.Sprintf("#%d", index)
+		validator.addError("host %s: name is required", hostName)
+	} else if validator.hostNames[strings.ToUpper(hostName)] {
+		validator.addError("host %s: duplicate host name", hostName)
+	}
+
+	validator.hostNames[strings.ToUpper(hostName)] = true
+
+	if hostConfig.Ip == "" {
+		validator.addError("host %s: ip is required", hostName)
+	}
+
+	if hostConfig.MaxAliveTime < 0 {
+		validator.addError("host %s: maxAliveTime must not be negative", hostName)
+	}
+
+	if hostConfig.StartTimeout < 0 {
+		validator.addError("host %s: startTimeout must not be negative", hostName)
+	}
+
+	if hostConfig.StopTimeout < 0 {
+		validator.addError("host %s: stopTimeout must not be negative", hostName)
+	}
+
+	validator.validateDriver(hostName, hostConfig)
+
+	// A simulated host is never woken, stopped or reached through ssh
+	if !hostDriver.IsSimulated(hostConfig) {
+		validator.validateWake(hostName, hostConfig)
+		validator.validateSleep(hostName, hostConfig)
+
+		if hostConfig.SSHPort != "" || usesHostSSH(hostConfig) {
+			validator.validateSSHTarget(fmt.Sprintf("host %s", hostName), &config.SSHTargetConfig{
+				Ip:          hostConfig.Ip,
+				SSHUsername: hostConfig.SSHUsername,
+				SSHPort:     hostConfig.SSHPort,
+			})
+		}
+	}
+
+	for _, probeConfig := range hostConfig.ReadinessProbes {
+		if _, err := probe.NewProbe(probeConfig, hostConfig, 0); err != nil {
+			validator.addError("host %s: invalid readiness probe: %v", hostName, err)
+		}
+	}
+
+	if _, err := schedule.NewSchedule(hostConfig.Schedules); err != nil {
+		validator.addError("host %s: invalid schedule: %v", hostName, err)
+	}
+
+	if _, err := acl.NewList(hostConfig.Access); err != nil {
+		validator.addError("host %s: access: %v", hostName, err)
+	}
+
+	for _, proxyConfig := range hostConfig.Proxies {
+		validator.validateProxy(hostName, hostConfig, proxyConfig)
+	}
+}
+
+func (validator *validator) validateDriver(hostName string, hostConfig *config.HostConfig) {
+	driverConfig := hostConfig.Driver
+
+	if driverConfig == nil {
+		return
+	}
+
+	switch strings.ToLower(driverConfig.Type) {
+	case "", hostDriver.TypeMachine, hostDriver.TypeSimulator:
+	default:
+		validator.addError("host %s: unknown driver %s", hostName, driverConfig.Type)
+	}
+
+	if driverConfig.BootDelay < 0 || driverConfig.SleepDelay < 0 {
+		validator.addError("host %s: driver delays must not be negative", hostName)
+	}
+
+	if driverConfig.WakeFailureRate < 0 || driverConfig.WakeFailureRate > 1 || driverConfig.SleepFailureRate < 0 || driverConfig.SleepFailureRate > 1 {
+		validator.addError("host %s: driver failure rates must be between 0 and 1", hostName)
+	}
+
+	if driverConfig.ServerIp != "" && net.ParseIP(driverConfig.ServerIp) == nil {
+		validator.addError("host %s: invalid driver server ip %s", hostName, driverConfig.ServerIp)
+	}
+}
+
+func (validator *validator) validateWake(hostName string, hostConfig *config.HostConfig) {
+	if _, err := power.NewWakeStrategy(hostConfig); err != nil {
+		validator.addError("host %s: invalid wake config: %v", hostName, err)
+		return
+	}
+
+	wakeConfig := hostConfig.Wake
+	if wakeConfig == nil {
+		wakeConfig = &config.WakeConfig{}
+	}
+
+	wakeType := strings.ToLower(wakeConfig.Type)
+
+	if wakeType == "" {
+		wakeType = power.WakeTypeWol
+	}
+
+	// The magic packet of the wol and relay strategies is built from the mac address
+	if _, err := net.ParseMAC(hostConfig.MacAddress); err != nil && (hostConfig.MacAddress != "" || wakeType == power.WakeTypeWol || wakeType == power.WakeTypeRelay) {
+		validator.addError("host %s: invalid macAddress %q", hostName, hostConfig.MacAddress)
+	}
+
+	if wakeType == power.WakeTypeHttp && wakeConfig.Url == "" {
+		validator.addError("host %s: http wake strategy requires an url", hostName)
+	}
+
+	if wakeConfig.SSH != nil {
+		validator.validateSSHTarget(fmt.Sprintf("host %s wake", hostName), wakeConfig.SSH)
+	}
+}
+
+func (validator *validator) validateSleep(hostName string, hostConfig *config.HostConfig) {
+	if _, err := power.NewSleepStrategy(hostConfig); err != nil {
+		validator.addError("host %s: invalid sleep config: %v", hostName, err)
+		return
+	}
+
+	if hostConfig.Sleep == nil {
+		return
+	}
+
+	if strings.ToLower(hostConfig.Sleep.Type) == power.SleepTypeHttp && hostConfig.Sleep.Url == "" {
+		validator.addError("host %s: http sleep strategy requires an url", hostName)
+	}
+
+	for _, hook := range hostConfig.Sleep.PreSleepHooks {
+		switch strings.ToLower(hook.Type) {
+		case power.PreSleepHookCommand:
+			if hook.Command == "" {
+				validator.addError("host %s: command pre sleep hook requires a command", hostName)
+			}
+		case power.PreSleepHookContainers:
+			if len(hook.Containers) == 0 {
+				validator.addError("host %s: containers pre sleep hook requires containers", hostName)
+			}
+		default:
+			validator.addError("host %s: unknown pre sleep hook %s", hostName, hook.Type)
+		}
+	}
+}
+
+// usesHostSSH reports whether the host is reached through ssh to sleep, run hooks or probes
+func usesHostSSH(hostConfig *config.HostConfig) bool {
+	if hostConfig.Sleep == nil || strings.ToLower(hostConfig.Sleep.Type) != power.SleepTypeHttp {
+		return true
+	}
+
+	if len(hostConfig.Sleep.PreSleepHooks) > 0 {
+		return true
+	}
+
+	for _, probeConfig := range hostConfig.ReadinessProbes {
+		if strings.ToLower(probeConfig.Type) == probe.TypeCommand {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (validator *validator) validateSSHTarget(context string, target *config.SSHTargetConfig) {
+	if target.Ip == "" {
+		validator.addError("%s: ssh ip is required", context)
+	}
+
+	if target.SSHUsername == "" {
+		validator.addError("%s: sshUsername is required", context)
+	}
+
+	if port, err := strconv.Atoi(target.SSHPort); err != nil || port <= 0 || port > 65535 {
+		validator.addError("%s: invalid sshPort %q", context, target.SSHPort)
+	}
+}
+
+func (validator *validator) validateProxy(hostName string, hostConfig *config.HostConfig, proxyConfig *config.ProxyConfig) {
+	proxyName := fmt.Sprintf("host %s: proxy %s", hostName, proxyConfig.Key)
+
+	if proxyConfig.Name == "" {
+		validator.addError("%s: name is required", proxyName)
+	}
+
+	if proxyConfig.Protocol != config.ProtocolTCP && proxyConfig.Protocol != config.ProtocolUDP {
+		validator.addError("%s: unsupported protocol %s", proxyName, proxyConfig.Protocol)
+	}
+
+	if proxyConfig.ListenPort <= 0 || proxyConfig.ListenPort > 65535 {
+		validator.addError("%s: invalid listenPort %d", proxyName, proxyConfig.ListenPort)
+	}
+
+	if proxyConfig.ServerPort <= 0 || proxyConfig.ServerPort > 65535 {
+		validator.addError("%s: invalid serverPort %d", proxyName, proxyConfig.ServerPort)
+	}
+
+	listenKey := fmt.Sprintf("%d/%s", proxyConfig.ListenPort, proxyConfig.Protocol)
+
+	if len(proxyConfig.Hostnames) > 0 {
+		validator.validateSharedProxy(proxyName, listenKey, proxyConfig)
+	} else if usedBy, exists := validator.listenPorts[listenKey]; exists {
+		validator.addError("%s: listen port %s already used by %s", proxyName, listenKey, usedBy)
+	} else if _, shared := validator.sharedPorts[listenKey]; shared {
+		validator.addError("%s: listen port %s is shared by proxies having hostnames", proxyName, listenKey)
+	} else {
+		validator.listenPorts[listenKey] = proxyName
+	}
+
+	if proxyConfig.ReadinessProbe != nil {
+		if _, err := probe.NewProbe(proxyConfig.ReadinessProbe, hostConfig, proxyConfig.ServerPort); err != nil {
+			validator.addError("%s: invalid readiness probe: %v", proxyName, err)
+		}
+	}
+
+	if _, err := passive.NewPassive(proxyConfig.Passive, "", nil); err != nil {
+		validator.addError("%s: invalid passive config: %v", proxyName, err)
+	}
+
+	if proxyConfig.Activity != nil {
+		for _, cidr := range proxyConfig.Activity.ExcludeCidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				validator.addError("%s: invalid excluded cidr %s", proxyName, cidr)
+			}
+		}
+	}
+
+	if _, err := acl.NewList(proxyConfig.Access); err != nil {
+		validator.addError("%s: access: %v", proxyName, err)
+	}
+
+	if limits := proxyConfig.Limits; limits != nil {
+		if limits.MaxConnections < 0 || limits.MaxConnectionsPerClient < 0 || limits.ConnectionsPerSecond < 0 ||
+			limits.UploadBytesPerSecond < 0 || limits.DownloadBytesPerSecond < 0 {
+			validator.addError("%s: limits must not be negative", proxyName)
+		}
+	}
+
+	if !proxyProtocol.IsValidVersion(proxyConfig.SendProxyProtocol) {
+		validator.addError("%s: sendProxyProtocol must be v1 or v2", proxyName)
+	}
+
+	if (proxyConfig.SendProxyProtocol != "" || proxyConfig.AcceptProxyProtocol) && proxyConfig.Protocol != config.ProtocolTCP {
+		validator.addError("%s: the proxy protocol is only supported by tcp proxies", proxyName)
+	}
+
+	if proxyConfig.AcceptProxyProtocol && len(proxyConfig.TrustedProxies) == 0 {
+		validator.addError("%s: acceptProxyProtocol requires trustedProxies", proxyName)
+	}
+
+	if _, err := acl.NewList(&config.AccessConfig{Allow: proxyConfig.TrustedProxies}); err != nil {
+		validator.addError("%s: trustedProxies: %v", proxyName, err)
+	}
+}
+
+// validateSharedProxy checks the hostnames of a proxy sharing its listen port
+func (validator *validator) validateSharedProxy(proxyName string, listenKey string, proxyConfig *config.ProxyConfig) {
+	if proxyConfig.Protocol != config.ProtocolTCP {
+		validator.addError("%s: hostnames are only supported by tcp proxies", proxyName)
+		return
+	}
+
+	if usedBy, exists := validator.listenPorts[listenKey]; exists {
+		validator.addError("%s: listen port %s already used by %s, which has no hostnames", proxyName, listenKey, usedBy)
+		return
+	}
+
+	sharedPort, exists := validator.sharedPorts[listenKey]
+
+	if !exists {
+		sharedPort = &sharedPortUsage{
+			acceptProxyProtocol: proxyConfig.AcceptProxyProtocol,
+			trustedProxies:      proxyConfig.TrustedProxies,
+			hostnames:           make(map[string]string),
+		}
+		validator.sharedPorts[listenKey] = sharedPort
+	} else if sharedPort.acceptProxyProtocol != proxyConfig.AcceptProxyProtocol {
+		validator.addError("%s: acceptProxyProtocol must be the same for every proxy of the listen port %s", proxyName, listenKey)
+	} else if !slices.Equal(sharedPort.trustedProxies, proxyConfig.TrustedProxies) {
+		validator.addError("%s: trustedProxies must be the same for every proxy of the listen port %s", proxyName, listenKey)
+	}
+
+	for _, hostname := range proxyConfig.Hostnames {
+		hostname = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+
+		if hostname == "" || strings.Contains(strings.TrimPrefix(hostname, "*."), "*") {
+			validator.addError("%s: invalid hostname %q, only a leading *. wildcard is supported", proxyName, hostname)
+			continue
+		}
+
+		if usedBy, exists := sharedPort.hostnames[hostname]; exists {
+			validator.addError("%s: hostname %s already routed to %s", proxyName, hostname, usedBy)
+			continue
+		}
+
+		sharedPort.hostnames[hostname] = proxyName
+	}
+}
+
+// validateDependencies checks that the dependencies of the hosts exist and do not form a cycle
+func (validator *validator) validateDependencies(configFile *config.AppConfigFile) {
+	hostConfigs := make(map[string]*config.HostConfig)
+
+	for _, hostConfig := range configFile.ProxyHosts {
+		hostConfigs[strings.ToUpper(hostConfig.Name)] = hostConfig
+	}
+
+	for _, hostConfig := range configFile.ProxyHosts {
+		for _, dependency := range hostConfig.DependsOn {
+			if _, exists := hostConfigs[strings.ToUpper(dependency)]; !exists {
+				validator.addError("host %s: depends on unknown host %s", hostConfig.Name, dependency)
+			}
+		}
+	}
+
+	if len(validator.errors) > 0 {
+		return
+	}
+
+	// Hosts absent from states are not visited yet
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	states := make(map[string]int)
+
+	var visit func(hostConfig *config.HostConfig, path []string) error
+	visit = func(hostConfig *config.HostConfig, path []string) error {
+		hostKey := strings.ToUpper(hostConfig.Name)
+		path = append(path, hostConfig.Name)
+
+		switch states[hostKey] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+
+		states[hostKey] = visiting
+
+		for _, dependency := range hostConfig.DependsOn {
+			if err := visit(hostConfigs[strings.ToUpper(dependency)], path); err != nil {
+				return err
+			}
+		}
+
+		states[hostKey] = visited
+
+		return nil
+	}
+
+	for _, hostConfig := range configFile.ProxyHosts {
+		if err := visit(hostConfig, nil); err != nil {
+			validator.errors = append(validator.errors, err)
+			return
+		}
+	}
+}
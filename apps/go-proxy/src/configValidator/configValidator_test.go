@@ -0,0 +1,166 @@
+package configValidator
+
+import (
+	"slices"
+	"testing"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+// newHost returns a valid host reached through ssh and woken with wol
+func newHost(name string, proxies ...*config.ProxyConfig) *config.HostConfig {
+	return &config.HostConfig{
+		Name:        name,
+		Ip:          "192.168.1.10",
+		MacAddress:  "00:11:22:33:44:55",
+		SSHUsername: "admin",
+		SSHPort:     "22",
+		Proxies:     proxies,
+	}
+}
+
+func newProxy(name string, listenPort int, protocol string) *config.ProxyConfig {
+	return &config.ProxyConfig{
+		Name:       name,
+		ListenPort: listenPort,
+		ServerPort: 80,
+		Protocol:   protocol,
+		Key:        config.GetProxyKey(name, listenPort, protocol),
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    func() []*config.HostConfig
+		expected []string
+	}{
+		{
+			name: "valid",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server", newProxy("web", 8080, config.ProtocolTCP), newProxy("dns", 8080, config.ProtocolUDP))
+				backup := newHost("backup")
+				backup.DependsOn = []string{"SERVER"}
+
+				return []*config.HostConfig{server, backup}
+			},
+		},
+		{
+			name: "self dependency",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.DependsOn = []string{"server"}
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{"dependency cycle: server -> server"},
+		},
+		{
+			name: "dependency cycle",
+			hosts: func() []*config.HostConfig {
+				a, b, c := newHost("a"), newHost("b"), newHost("c")
+				a.DependsOn = []string{"b"}
+				b.DependsOn = []string{"c"}
+				c.DependsOn = []string{"a"}
+
+				return []*config.HostConfig{a, b, c}
+			},
+			expected: []string{"dependency cycle: a -> b -> c -> a"},
+		},
+		{
+			name: "unknown dependency",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.DependsOn = []string{"nas"}
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{"host server: depends on unknown host nas"},
+		},
+		{
+			name: "duplicate listen port",
+			hosts: func() []*config.HostConfig {
+				return []*config.HostConfig{
+					newHost("server", newProxy("web", 8080, config.ProtocolTCP)),
+					newHost("backup", newProxy("ui", 8080, config.ProtocolTCP)),
+				}
+			},
+			expected: []string{"host backup: proxy ui:8080: listen port 8080/tcp already used by host server: proxy web:8080"},
+		},
+		{
+			name: "duplicate host name",
+			hosts: func() []*config.HostConfig {
+				return []*config.HostConfig{newHost("server"), newHost("Server")}
+			},
+			expected: []string{"host Server: duplicate host name"},
+		},
+		{
+			name: "invalid mac address",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.MacAddress = "00:11:22"
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{`host server: invalid macAddress "00:11:22"`},
+		},
+		{
+			name: "missing mac address for wol",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.MacAddress = ""
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{`host server: invalid macAddress ""`},
+		},
+		{
+			name: "invalid ssh settings",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.SSHUsername = ""
+				server.SSHPort = "ssh"
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{"host server: sshUsername is required", `host server: invalid sshPort "ssh"`},
+		},
+		{
+			name: "negative timeouts",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.StartTimeout = -1
+				server.StopTimeout = -1
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{"host server: startTimeout must not be negative", "host server: stopTimeout must not be negative"},
+		},
+		{
+			name: "dependencies not checked with other errors",
+			hosts: func() []*config.HostConfig {
+				server := newHost("server")
+				server.Ip = ""
+				server.DependsOn = []string{"nas"}
+
+				return []*config.HostConfig{server}
+			},
+			expected: []string{"host server: ip is required", "host server: ssh ip is required"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := Validate(&config.AppConfigFile{ProxyHosts: test.hosts()})
+
+			messages := []string{}
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+
+			if !slices.Equal(messages, test.expected) {
+				t.Errorf("expected the errors %q, got %q", test.expected, messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time given to the requests, the event stream is not limited
+const requestTimeout = 30 * time.Second
+
+type hostStatus struct {
+	Name           string    `json:"name"`
+	State          string    `json:"state"`
+	StateChangedAt time.Time `json:"stateChangedAt"`
+	Activity       struct {
+		LastPacketDate time.Time `json:"lastPacketDate"`
+		LastProxyName  string    `json:"lastProxyName"`
+		LastClientAddr string    `json:"lastClientAddr"`
+	} `json:"activity"`
+	Autostop autostopStatus `json:"autostop"`
+}
+
+type autostopStatus struct {
+	Enabled          bool `json:"enabled"`
+	MaxAliveTime     int  `json:"maxAliveTime"`
+	RemainingSeconds *int `json:"remainingSeconds"`
+}
+
+type operation struct {
+	Id     string `json:"id"`
+	Type   string `json:"type"`
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+type streamEvent struct {
+	Type string          `json:"type"`
+	Host string          `json:"host"`
+	Date time.Time       `json:"date"`
+	Data json.RawMessage `json:"data"`
+}
+
+// client calls the v2 api of a go-proxy server
+type client struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+func newClient(baseUrl string) *client {
+	return &client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		httpClient: &http.Client{},
+	}
+}
+
+// do sends the request and returns the status and the raw body, errors returned by the api are returned as errors
+func (client *client) do(method string, path string, body any) (int, []byte, error) {
+	var requestBody io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		requestBody = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, method, client.baseUrl+path, requestBody)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		apiError := struct {
+			Error string `json:"error"`
+		}{}
+
+		if json.Unmarshal(data, &apiError) == nil && apiError.Error != "" {
+			return response.StatusCode, nil, fmt.Errorf("%s", apiError.Error)
+		}
+
+		return response.StatusCode, nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return response.StatusCode, data, nil
+}
+
+// get sends a get request and decodes the body into result, the raw body is returned for the json output
+func (client *client) get(path string, result any) ([]byte, error) {
+	_, data, err := client.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, json.Unmarshal(data, result)
+}
+
+func hostPath(hostName string) string {
+	return "/api/v2/hosts/" + url.PathEscape(hostName)
+}
+
+// streamEvents calls onEvent for each event sent by the server until the stream ends
+func (client *client) streamEvents(hostName string, eventType string, onEvent func(event *streamEvent, raw []byte)) error {
+	query := url.Values{}
+
+	if hostName != "" {
+		query.Set("host", hostName)
+	}
+
+	if eventType != "" {
+		query.Set("type", eventType)
+	}
+
+	response, err := client.httpClient.Get(client.baseUrl + "/api/v2/events?" + query.Encode())
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+
+	for scanner.Scan() {
+		data, isData := strings.CutPrefix(scanner.Text(), "data: ")
+
+		if !isData {
+			continue
+		}
+
+		event := &streamEvent{}
+
+		if err := json.Unmarshal([]byte(data), event); err != nil {
+			return fmt.Errorf("invalid event: %v", err)
+		}
+
+		onEvent(event, []byte(data))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("event stream closed by the server")
+}
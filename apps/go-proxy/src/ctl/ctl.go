@@ -0,0 +1,383 @@
+// Package ctl is the command line client of the go-proxy api, run with `go-proxy ctl`.
+//
+// The exit code reflects the host state so that scripts can test it: 0 when the host is started (or when the
+// command succeeded), 3 when it is stopped, 4 while it is starting or stopping, 1 on errors and 2 on invalid usage.
+package ctl
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/libs/utils"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const (
+	exitOk            = 0
+	exitError         = 1
+	exitUsage         = 2
+	exitStopped       = 3
+	exitTransitioning = 4
+)
+
+// Delay between two polls of an operation waited for
+const pollInterval = time.Second
+
+const usage = `Usage: go-proxy ctl <command> [flags]
+
+Commands:
+  list                          List the hosts
+  status <host>                 Show a host, the exit code reflects its state
+  wake <host> [--wait]          Start a host
+  sleep <host> [--wait]         Stop a host
+  autostop <host> on|off        Enable or disable the autostop of a host
+  watch [host] [--type prefix]  Print the events as they happen
+
+Flags:
+  --server url       Api of go-proxy (env GO_PROXY_URL, default http://localhost:SERVER_PORT)
+  --output format    table or json (default table)
+  --timeout duration Maximum time waited by --wait (default 5m)
+  --wait             Wait for the host to reach the state, a start or stop in progress is waited for
+
+Exit codes: 0 started or success, 1 error, 2 invalid usage, 3 stopped, 4 starting or stopping
+`
+
+type options struct {
+	server  string
+	output  string
+	wait    bool
+	timeout time.Duration
+	// Prefix of the event types printed by watch
+	eventType string
+}
+
+type command struct {
+	minArgs int
+	maxArgs int
+	run     func(client *client, opts *options, args []string) int
+}
+
+var commands = map[string]command{
+	"list":     {minArgs: 0, maxArgs: 0, run: runList},
+	"status":   {minArgs: 1, maxArgs: 1, run: runStatus},
+	"wake":     {minArgs: 1, maxArgs: 1, run: runWake},
+	"sleep":    {minArgs: 1, maxArgs: 1, run: runSleep},
+	"autostop": {minArgs: 2, maxArgs: 2, run: runAutostop},
+	"watch":    {minArgs: 0, maxArgs: 1, run: runWatch},
+}
+
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// Run runs the command of the arguments and returns the exit code
+func Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	cmd, exists := commands[args[0]]
+
+	if !exists {
+		fmt.Fprintf(stderr, "Unknown command %s\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	opts := &options{}
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+
+	flagSet.StringVar(&opts.server, "server", utils.GetEnv("GO_PROXY_URL", fmt.Sprintf("http://localhost:%d", config.Config.ServerPort)), "")
+	flagSet.StringVar(&opts.output, "output", "table", "")
+	flagSet.BoolVar(&opts.wait, "wait", false, "")
+	flagSet.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "")
+	flagSet.StringVar(&opts.eventType, "type", "", "")
+
+	positional, err := parseArgs(flagSet, args[1:])
+
+	if err == nil && opts.output != "table" && opts.output != "json" {
+		err = fmt.Errorf("invalid output %s", opts.output)
+	}
+
+	if err == nil && (len(positional) < cmd.minArgs || len(positional) > cmd.maxArgs) {
+		err = fmt.Errorf("invalid number of arguments")
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n\n%s", args[0], err, usage)
+		return exitUsage
+	}
+
+	return cmd.run(newClient(opts.server), opts, positional)
+}
+
+// parseArgs parses the flags wherever they are placed among the arguments and returns the other arguments
+func parseArgs(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		if err := flagSet.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = flagSet.Args()
+
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func fail(err error) int {
+	fmt.Fprintf(stderr, "Error: %v\n", err)
+	return exitError
+}
+
+// stateExitCode returns the exit code reflecting the state of the host
+func stateExitCode(state string) int {
+	switch state {
+	case hostState.Started.String():
+		return exitOk
+	case hostState.Stopped.String():
+		return exitStopped
+	case hostState.Starting.String(), hostState.Stopping.String():
+		return exitTransitioning
+	default:
+		return exitError
+	}
+}
+
+func runList(client *client, opts *options, args []string) int {
+	hosts := []*hostStatus{}
+
+	data, err := client.get("/api/v2/hosts", &hosts)
+	if err != nil {
+		return fail(err)
+	}
+
+	if opts.output == "json" {
+		stdout.Write(data)
+		return exitOk
+	}
+
+	printHosts(hosts)
+
+	return exitOk
+}
+
+func runStatus(client *client, opts *options, args []string) int {
+	host := &hostStatus{}
+
+	data, err := client.get(hostPath(args[0]), host)
+	if err != nil {
+		return fail(err)
+	}
+
+	printHost(opts, host, data)
+
+	return stateExitCode(host.State)
+}
+
+func runWake(client *client, opts *options, args []string) int {
+	return changeState(client, opts, args[0], "start", hostState.Started)
+}
+
+func runSleep(client *client, opts *options, args []string) int {
+	return changeState(client, opts, args[0], "stop", hostState.Stopped)
+}
+
+// changeState starts the operation on the host, and with --wait waits for it to end and for the host to reach the target state.
+// With --wait, a start or stop already in progress is waited for, and the operation is sent again if it did not reach the target
+func changeState(client *client, opts *options, hostName string, action string, target hostState.State) int {
+	deadline := time.Now().Add(opts.timeout)
+
+	status, data, err := client.do(http.MethodPost, hostPath(hostName)+"/"+action, nil)
+
+	for opts.wait && status == http.StatusConflict {
+		host := &hostStatus{}
+
+		if data, err = waitTransition(client, opts, hostName, host, deadline); err != nil {
+			return fail(err)
+		}
+
+		if host.State == target.String() {
+			printHost(opts, host, data)
+			return exitOk
+		}
+
+		status, data, err = client.do(http.MethodPost, hostPath(hostName)+"/"+action, nil)
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	// The host already is in the target state
+	if status == http.StatusOK {
+		host := &hostStatus{}
+
+		if err := unmarshal(data, host); err != nil {
+			return fail(err)
+		}
+
+		printHost(opts, host, data)
+
+		return exitOk
+	}
+
+	op := &operation{}
+
+	if err := unmarshal(data, op); err != nil {
+		return fail(err)
+	}
+
+	if !opts.wait {
+		printOperation(opts, op, data)
+		return exitOk
+	}
+
+	if op, data, err = waitOperation(client, opts, op); err != nil {
+		return fail(err)
+	}
+
+	if op.Status != "succeeded" {
+		printOperation(opts, op, data)
+		return fail(fmt.Errorf("%s of %s failed: %s", action, hostName, op.Error))
+	}
+
+	host := &hostStatus{}
+
+	if data, err = client.get(hostPath(hostName), host); err != nil {
+		return fail(err)
+	}
+
+	printHost(opts, host, data)
+
+	if host.State == target.String() {
+		return exitOk
+	}
+
+	if code := stateExitCode(host.State); code == exitTransitioning {
+		return code
+	}
+
+	return exitError
+}
+
+// waitTransition polls the host until it is no longer starting or stopping, or until the deadline
+func waitTransition(client *client, opts *options, hostName string, host *hostStatus, deadline time.Time) ([]byte, error) {
+	for {
+		data, err := client.get(hostPath(hostName), host)
+		if err != nil {
+			return nil, err
+		}
+
+		if stateExitCode(host.State) != exitTransitioning {
+			return data, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s still %s after %s", hostName, strings.ToLower(host.State), opts.timeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// waitOperation polls the operation until it is no longer running, or until the timeout
+func waitOperation(client *client, opts *options, op *operation) (*operation, []byte, error) {
+	deadline := time.Now().Add(opts.timeout)
+
+	for {
+		current := &operation{}
+
+		data, err := client.get("/api/v2/operations/"+op.Id, current)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if current.Status != "running" {
+			return current, data, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("%s of %s still running after %s", op.Type, op.Host, opts.timeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+func runAutostop(client *client, opts *options, args []string) int {
+	var enabled bool
+
+	switch strings.ToLower(args[1]) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		fmt.Fprintf(stderr, "autostop: expected on or off, got %s\n", args[1])
+		return exitUsage
+	}
+
+	_, data, err := client.do(http.MethodPut, hostPath(args[0])+"/autostop", map[string]bool{"enabled": enabled})
+	if err != nil {
+		return fail(err)
+	}
+
+	autostop := &autostopStatus{}
+
+	if err := unmarshal(data, autostop); err != nil {
+		return fail(err)
+	}
+
+	if opts.output == "json" {
+		stdout.Write(data)
+		return exitOk
+	}
+
+	fmt.Fprintf(stdout, "Autostop of %s: %s\n", args[0], formatEnabled(autostop.Enabled))
+
+	return exitOk
+}
+
+func runWatch(client *client, opts *options, args []string) int {
+	hostName := ""
+
+	if len(args) > 0 {
+		hostName = args[0]
+	}
+
+	err := client.streamEvents(hostName, opts.eventType, func(event *streamEvent, raw []byte) {
+		if opts.output == "json" {
+			fmt.Fprintf(stdout, "%s\n", raw)
+			return
+		}
+
+		printEvent(event)
+	})
+
+	return fail(err)
+}
+
+func unmarshal(data []byte, result any) error {
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid response from the server: %v", err)
+	}
+
+	return nil
+}
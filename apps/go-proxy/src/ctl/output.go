@@ -0,0 +1,94 @@
+package ctl
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+func printHosts(hosts []*hostStatus) {
+	writer := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "NAME\tSTATE\tSINCE\tAUTOSTOP\tLAST ACTIVITY\tPROXY\tCLIENT")
+
+	for _, host := range hosts {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			host.Name,
+			host.State,
+			formatAge(host.StateChangedAt),
+			formatAutostop(host.Autostop),
+			formatAge(host.Activity.LastPacketDate),
+			orDash(host.Activity.LastProxyName),
+			orDash(host.Activity.LastClientAddr),
+		)
+	}
+
+	writer.Flush()
+}
+
+// printHost prints the host as a table, or the raw response of the api with the json output
+func printHost(opts *options, host *hostStatus, data []byte) {
+	if opts.output == "json" {
+		stdout.Write(data)
+		return
+	}
+
+	printHosts([]*hostStatus{host})
+}
+
+func printOperation(opts *options, op *operation, data []byte) {
+	if opts.output == "json" {
+		stdout.Write(data)
+		return
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "OPERATION\tTYPE\tHOST\tSTATUS\tERROR")
+	fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", op.Id, op.Type, op.Host, op.Status, orDash(op.Error))
+
+	writer.Flush()
+}
+
+func printEvent(event *streamEvent) {
+	data := "-"
+
+	if len(event.Data) > 0 {
+		data = string(event.Data)
+	}
+
+	fmt.Fprintf(stdout, "%s  %-18s  %-15s  %s\n", event.Date.Local().Format(time.DateTime), event.Type, orDash(event.Host), data)
+}
+
+// formatAge returns the time elapsed since the date, or a dash when it is not set
+func formatAge(date time.Time) string {
+	if date.IsZero() {
+		return "-"
+	}
+
+	return time.Since(date).Round(time.Second).String() + " ago"
+}
+
+func formatAutostop(autostop autostopStatus) string {
+	if autostop.Enabled && autostop.RemainingSeconds != nil {
+		return fmt.Sprintf("on (%s left)", time.Duration(*autostop.RemainingSeconds)*time.Second)
+	}
+
+	return formatEnabled(autostop.Enabled)
+}
+
+func formatEnabled(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+
+	return "off"
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -6,10 +6,10 @@ import (
 	"fmt"
 
 	"mgarnier11.fr/go/libs/dockerssh"
-	"mgarnier11.fr/go/libs/logger"
 	"mgarnier11.fr/go/libs/sshutils"
 
 	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/proxyProtocol"
 
 	"net"
 	"net/http"
@@ -17,35 +17,135 @@ import (
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"golang.org/x/crypto/ssh"
 )
 
-func checkPortAndAddService(containerName string, traefikConfPort string) (*config.ProxyConfig, error) {
+// checkPortAndAddService parses a port label, formatted as "port", "listenPort:serverPort" and optionally suffixed with "/protocol"
+func checkPortAndAddService(containerName string, traefikConfPort string, defaultProtocol string) (*config.ProxyConfig, error) {
 
 	if traefikConfPort == "" {
 		return nil, errors.New("traefik-conf.port not found")
 	}
 
-	port, err := strconv.Atoi(traefikConfPort)
+	protocol := defaultProtocol
+
+	if portString, portProtocol, found := strings.Cut(strings.TrimSpace(traefikConfPort), "/"); found {
+		traefikConfPort = portString
+		protocol = strings.ToLower(portProtocol)
+	}
+
+	if protocol != config.ProtocolTCP && protocol != config.ProtocolUDP {
+		return nil, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+
+	listenPortString, serverPortString, found := strings.Cut(traefikConfPort, ":")
+	if !found {
+		serverPortString = listenPortString
+	}
+
+	listenPort, err := parsePort(listenPortString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serverPort, err := parsePort(serverPortString)
 
 	if err != nil {
 		return nil, err
 	}
 
 	proxyConfig := &config.ProxyConfig{
-		ListenPort: port,
-		ServerPort: port,
-		Protocol:   "tcp",
+		ListenPort: listenPort,
+		ServerPort: serverPort,
+		Protocol:   protocol,
 		Name:       containerName,
-		Key:        fmt.Sprintf("%s:%d", containerName, port),
+		Key:        config.GetProxyKey(containerName, listenPort, protocol),
 	}
 
 	return proxyConfig, nil
 }
 
-func GetDockerClient(sshUsername string, hostIp string, sshPort int) (*client.Client, error) {
+func parsePort(portString string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(portString))
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", portString)
+	}
+
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+
+	return port, nil
+}
+
+// parseContainerProxies returns the proxies declared by the labels of a container, with the errors of the invalid labels
+func parseContainerProxies(containerName string, labels map[string]string) ([]*config.ProxyConfig, []error) {
+	proxies := []*config.ProxyConfig{}
+	labelErrors := []error{}
+
+	protocol := config.ProtocolTCP
+	if labelProtocol := labels["proxy.protocol"]; labelProtocol != "" {
+		protocol = strings.ToLower(labelProtocol)
+	}
+
+	if traefikConfPort, exists := labels["traefik-conf.port"]; exists {
+		proxyConfig, err := checkPortAndAddService(containerName, traefikConfPort, protocol)
+
+		if err != nil {
+			labelErrors = append(labelErrors, fmt.Errorf("traefik-conf.port: %v", err))
+		} else {
+			proxyConfig.Http = strings.EqualFold(labels["proxy.http"], "true")
+
+			if responders := labels["proxy.responders"]; responders != "" {
+				proxyConfig.Passive = &config.PassiveConfig{
+					Responders: strings.Split(responders, ","),
+					Motd:       labels["proxy.motd"],
+				}
+			}
+
+			if hostnames := labels["proxy.hostnames"]; hostnames != "" {
+				if proxyConfig.Protocol == config.ProtocolTCP {
+					proxyConfig.Hostnames = strings.Split(hostnames, ",")
+				} else {
+					labelErrors = append(labelErrors, errors.New("proxy.hostnames: only supported by tcp proxies"))
+				}
+			}
+
+			proxyConfig.SendProxyProtocol = strings.ToLower(labels["proxy.sendProxyProtocol"])
+
+			if !proxyProtocol.IsValidVersion(proxyConfig.SendProxyProtocol) {
+				labelErrors = append(labelErrors, fmt.Errorf("proxy.sendProxyProtocol: unknown version %s", proxyConfig.SendProxyProtocol))
+				proxyConfig.SendProxyProtocol = ""
+			} else if proxyConfig.SendProxyProtocol != "" && proxyConfig.Protocol != config.ProtocolTCP {
+				labelErrors = append(labelErrors, errors.New("proxy.sendProxyProtocol: only supported by tcp proxies"))
+				proxyConfig.SendProxyProtocol = ""
+			}
+
+			proxies = append(proxies, proxyConfig)
+		}
+	}
+
+	if additionalPorts := labels["proxy.ports"]; additionalPorts != "" {
+		for _, port := range strings.Split(additionalPorts, ",") {
+			proxyConfig, err := checkPortAndAddService(containerName, port, config.ProtocolTCP)
+
+			if err != nil {
+				labelErrors = append(labelErrors, fmt.Errorf("proxy.ports %q: %v", port, err))
+				continue
+			}
+
+			proxies = append(proxies, proxyConfig)
+		}
+	}
+
+	return proxies, labelErrors
+}
+
+// newDockerClient returns a docker client connected through ssh, without timeout so that it can follow the events
+func newDockerClient(sshUsername string, hostIp string, sshPort string) (*client.Client, error) {
 	authMethod, err := sshutils.GetSSHKeyAuth(config.Config.SSHPrivateKey)
 
 	if err != nil {
@@ -56,11 +156,12 @@ func GetDockerClient(sshUsername string, hostIp string, sshPort int) (*client.Cl
 		User:            sshUsername,
 		Auth:            []ssh.AuthMethod{authMethod},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Replace with a proper callback in production
+		Timeout:         10 * time.Second,
 	}
 
 	sshDialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		return dockerssh.NewSSHDialer(
-			net.JoinHostPort(hostIp, strconv.Itoa(sshPort)),
+			net.JoinHostPort(hostIp, sshPort),
 			sshConfig,
 		)
 	}
@@ -71,75 +172,11 @@ func GetDockerClient(sshUsername string, hostIp string, sshPort int) (*client.Cl
 		Transport: &http.Transport{
 			DialContext: sshDialer,
 		},
-		Timeout: 2 * time.Second,
 	}
 
-	var clientOpts []client.Opt
-
-	clientOpts = append(clientOpts,
+	return client.NewClientWithOpts(
 		client.WithHTTPClient(httpClient),
 		client.WithDialContext(sshDialer),
+		client.WithAPIVersionNegotiation(),
 	)
-
-	client, err := client.NewClientWithOpts(clientOpts...)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return client, nil
-}
-
-func GetProxiesFromDocker(sshUsername string, hostIp string, sshPort string, logger *logger.Logger) ([]*config.ProxyConfig, error) {
-
-	dockerClient, err := dockerssh.GetDockerClient(sshUsername, hostIp, sshPort, config.Config.SSHPrivateKey)
-
-	if err != nil {
-		return nil, err
-	}
-	defer dockerClient.Close()
-
-	containers, err := dockerClient.ContainerList(context.Background(), container.ListOptions{})
-
-	if err != nil {
-		return nil, err
-	}
-
-	proxies := []*config.ProxyConfig{}
-
-	for _, container := range containers {
-		containerName := strings.Replace(container.Names[0], "/", "", 1)
-
-		additionalPorts := container.Labels["proxy.ports"]
-
-		proxyConfig, err := checkPortAndAddService(containerName, container.Labels["traefik-conf.port"])
-
-		if err != nil {
-			if logger != nil {
-				logger.Verbosef("Error while checking port and adding service for container %s: %v", containerName, err)
-			}
-			continue
-		}
-
-		proxies = append(proxies, proxyConfig)
-
-		if additionalPorts != "" {
-			ports := strings.Split(additionalPorts, ",")
-
-			for _, port := range ports {
-				proxyConfig, err := checkPortAndAddService(containerName, port)
-
-				if err != nil {
-					if logger != nil {
-						logger.Verbosef("Error adding additionnal ports for container %s: %v", containerName, err)
-					}
-					continue
-				}
-
-				proxies = append(proxies, proxyConfig)
-			}
-		}
-	}
-
-	return proxies, nil
 }
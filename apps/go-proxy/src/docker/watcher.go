@@ -0,0 +1,216 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	watcherRetryDelay  = 10 * time.Second
+	watcherListTimeout = 30 * time.Second
+)
+
+// LabelError is an invalid proxy label found on a container
+type LabelError struct {
+	Container string `json:"container"`
+	Error     string `json:"error"`
+}
+
+type containerProxies struct {
+	name    string
+	proxies []*config.ProxyConfig
+	errors  []error
+}
+
+// Watcher follows the docker events of a host to keep the proxies of its running containers up to date
+type Watcher struct {
+	sshUsername string
+	hostIp      string
+	sshPort     string
+	logger      *logger.Logger
+	// Called with every proxy of the running containers each time a container starts or stops
+	onChange func(proxies []*config.ProxyConfig)
+
+	// Running containers by id
+	containers map[string]*containerProxies
+	connected  bool
+	mutex      sync.Mutex
+}
+
+func NewWatcher(hostConfig *config.HostConfig, logger *logger.Logger, onChange func(proxies []*config.ProxyConfig)) *Watcher {
+	return &Watcher{
+		sshUsername: hostConfig.SSHUsername,
+		hostIp:      hostConfig.Ip,
+		sshPort:     hostConfig.SSHPort,
+		logger:      logger,
+		onChange:    onChange,
+		containers:  make(map[string]*containerProxies),
+	}
+}
+
+// Run follows the events until the context is cancelled, reconnecting when the subscription fails
+func (watcher *Watcher) Run(ctx context.Context) {
+	for {
+		err := watcher.watch(ctx)
+
+		watcher.mutex.Lock()
+		watcher.connected = false
+		watcher.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		watcher.logger.Errorf("Docker events subscription failed, retrying in %v: %v", watcherRetryDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watcherRetryDelay):
+		}
+	}
+}
+
+func (watcher *Watcher) watch(ctx context.Context) error {
+	dockerClient, err := newDockerClient(watcher.sshUsername, watcher.hostIp, watcher.sshPort)
+
+	if err != nil {
+		return err
+	}
+	defer dockerClient.Close()
+
+	// Subscribe before listing the containers so that no event is missed in between
+	messages, errs := dockerClient.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("type", string(events.ContainerEventType))),
+	})
+
+	listCtx, cancel := context.WithTimeout(ctx, watcherListTimeout)
+	containers, err := dockerClient.ContainerList(listCtx, container.ListOptions{})
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	watcher.mutex.Lock()
+	watcher.connected = true
+	watcher.containers = make(map[string]*containerProxies)
+
+	for _, container := range containers {
+		watcher.containers[container.ID] = newContainerProxies(strings.TrimPrefix(container.Names[0], "/"), container.Labels)
+	}
+	watcher.mutex.Unlock()
+
+	watcher.logger.Infof("Following docker events, %d containers running", len(containers))
+
+	watcher.publish()
+
+	for {
+		select {
+		case message := <-messages:
+			watcher.handleEvent(message)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (watcher *Watcher) handleEvent(message events.Message) {
+	switch message.Action {
+	case events.ActionStart:
+		// The attributes of container events hold the name and the labels of the container
+		name := message.Actor.Attributes["name"]
+
+		watcher.logger.Debugf("Container %s started", name)
+
+		watcher.mutex.Lock()
+		watcher.containers[message.Actor.ID] = newContainerProxies(name, message.Actor.Attributes)
+		watcher.mutex.Unlock()
+	case events.ActionDie, events.ActionDestroy:
+		watcher.mutex.Lock()
+		_, exists := watcher.containers[message.Actor.ID]
+		delete(watcher.containers, message.Actor.ID)
+		watcher.mutex.Unlock()
+
+		if !exists {
+			return
+		}
+
+		watcher.logger.Debugf("Container %s stopped", message.Actor.Attributes["name"])
+	default:
+		return
+	}
+
+	watcher.publish()
+}
+
+func newContainerProxies(name string, labels map[string]string) *containerProxies {
+	proxies, labelErrors := parseContainerProxies(name, labels)
+
+	return &containerProxies{
+		name:    name,
+		proxies: proxies,
+		errors:  labelErrors,
+	}
+}
+
+func (watcher *Watcher) publish() {
+	watcher.mutex.Lock()
+	containers := slices.SortedFunc(maps.Values(watcher.containers), func(a, b *containerProxies) int {
+		return strings.Compare(a.name, b.name)
+	})
+	watcher.mutex.Unlock()
+
+	proxies := []*config.ProxyConfig{}
+
+	for _, container := range containers {
+		for _, err := range container.errors {
+			watcher.logger.Warnf("Invalid label on container %s: %v", container.name, err)
+		}
+
+		proxies = append(proxies, container.proxies...)
+	}
+
+	watcher.onChange(proxies)
+}
+
+// GetLabelErrors returns the invalid labels of the running containers
+func (watcher *Watcher) GetLabelErrors() []*LabelError {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	labelErrors := []*LabelError{}
+
+	for _, container := range watcher.containers {
+		for _, err := range container.errors {
+			labelErrors = append(labelErrors, &LabelError{Container: container.name, Error: err.Error()})
+		}
+	}
+
+	slices.SortFunc(labelErrors, func(a, b *LabelError) int {
+		return strings.Compare(a.Container, b.Container)
+	})
+
+	return labelErrors
+}
+
+// IsConnected reports whether the watcher currently follows the docker events
+func (watcher *Watcher) IsConnected() bool {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	return watcher.connected
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	HostState        Type = "host.state"
+	HostInactivity   Type = "host.inactivity"
+	ConnectionOpened Type = "connection.opened"
+	ConnectionClosed Type = "connection.closed"
+	ProxyAdded       Type = "proxy.added"
+	ProxyRemoved     Type = "proxy.removed"
+
+	subscriberBufferSize = 64
+)
+
+type Event struct {
+	Type Type      `json:"type"`
+	Host string    `json:"host"`
+	Date time.Time `json:"date"`
+	Data any       `json:"data,omitempty"`
+}
+
+type StateData struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+type InactivityData struct {
+	State string `json:"state"`
+	// Seconds before the inactivity timeout, negative once the timeout is reached
+	RemainingSeconds int `json:"remainingSeconds"`
+}
+
+type ConnectionData struct {
+	Proxy      string `json:"proxy"`
+	Protocol   string `json:"protocol"`
+	ClientAddr string `json:"clientAddr"`
+}
+
+type ProxyData struct {
+	Key        string `json:"key"`
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	ListenPort int    `json:"listenPort"`
+	ServerPort int    `json:"serverPort"`
+	Source     string `json:"source"`
+}
+
+var (
+	subscribers = make(map[int]chan Event)
+	nextId      = 0
+	mutex       sync.Mutex
+)
+
+// Publish sends the event to every subscriber, subscribers that are too slow miss it
+func Publish(eventType Type, hostName string, data any) {
+	event := Event{
+		Type: eventType,
+		Host: hostName,
+		Date: time.Now(),
+		Data: data,
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every published event and a function to unsubscribe
+func Subscribe() (<-chan Event, func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	id := nextId
+	nextId++
+
+	channel := make(chan Event, subscriberBufferSize)
+	subscribers[id] = channel
+
+	return channel, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if _, exists := subscribers[id]; exists {
+			delete(subscribers, id)
+			close(channel)
+		}
+	}
+}
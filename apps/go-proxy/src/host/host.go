@@ -2,50 +2,103 @@ package host
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"mgarnier11.fr/go/libs/colors"
 	"mgarnier11.fr/go/libs/logger"
-	"mgarnier11.fr/go/libs/ntfy"
-	"mgarnier11.fr/go/libs/utils"
 
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/auditLog"
 	"mgarnier11.fr/go/go-proxy/config"
 	"mgarnier11.fr/go/go-proxy/docker"
+	"mgarnier11.fr/go/go-proxy/events"
+	"mgarnier11.fr/go/go-proxy/hostDriver"
 	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/metrics"
+	"mgarnier11.fr/go/go-proxy/power"
 	"mgarnier11.fr/go/go-proxy/proxies"
+	"mgarnier11.fr/go/go-proxy/schedule"
+	"mgarnier11.fr/go/go-proxy/stateStore"
 
 	"github.com/charmbracelet/lipgloss"
 )
 
+// Activity is the last traffic that reset the inactivity timeout, ProxyName is empty when it was not caused by a proxy
+type Activity struct {
+	Date       time.Time
+	ProxyName  string
+	ClientAddr string
+}
+
+// Registry gives access to the other hosts, it is implemented by the host manager
+type Registry interface {
+	GetHost(name string) *Host
+	GetHosts() []*Host
+}
+
 type Host struct {
-	Proxies             map[string]*proxies.TCPProxy
-	State               hostState.State
-	LastPacketDate      time.Time
-	LastPacketProxyName string
-	Config              *config.HostConfig
+	Proxies              map[string]proxies.Proxy
+	State                *hostState.Machine
+	LastPacketDate       time.Time
+	LastPacketProxyName  string
+	LastPacketClientAddr string
+
+	// Replaced on reload and by SetAutostop, read with GetConfig
+	config   *config.HostConfig
+	logger   *logger.Logger
+	registry Registry
+
+	// Result of the last sleep request, set once the host has been stopped
+	lastSleepResult *power.SleepResult
+
+	// Last activity of each proxy
+	proxyActivity map[string]Activity
+
+	// Schedule built from scheduleConfig, rebuilt when the config is reloaded
+	schedule          *schedule.Schedule
+	scheduleConfig    *config.HostConfig
+	lastScheduleCheck time.Time
+
+	// Proxies of the running containers, kept while the host sleeps so that they can wake it
+	dockerProxies []*config.ProxyConfig
+	dockerWatcher hostDriver.Discoverer
 
-	logger *logger.Logger
+	// Protects Proxies, the config, the last packet fields, the last sleep result, the schedule and the docker fields
+	mutex sync.Mutex
+	// Serializes the updates of the proxies
+	proxiesMutex sync.Mutex
+
+	// Set while the readiness probes of the host run
+	readinessChecking atomic.Bool
 
 	waitGroup sync.WaitGroup
 	ctx       context.Context
 	cancel    context.CancelFunc
 }
 
-func NewHost(hostConfig *config.HostConfig) *Host {
+func NewHost(hostConfig *config.HostConfig, registry Registry) *Host {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	record := stateStore.GetHost(hostConfig.Name)
+
 	host := &Host{
-		Config:    hostConfig,
-		Proxies:   make(map[string]*proxies.TCPProxy),
-		State:     hostState.Stopped,
-		waitGroup: sync.WaitGroup{},
-		ctx:       ctx,
-		cancel:    cancel,
+		config:         hostConfig,
+		Proxies:        make(map[string]proxies.Proxy),
+		State:          restoreState(record),
+		LastPacketDate: time.Now(),
+		proxyActivity:  make(map[string]Activity),
+		registry:       registry,
+		waitGroup:      sync.WaitGroup{},
+		ctx:            ctx,
+		cancel:         cancel,
 		logger: logger.
 			NewLogger(
 				fmt.Sprintf("[%s]",
@@ -56,16 +109,49 @@ func NewHost(hostConfig *config.HostConfig) *Host {
 			),
 	}
 
-	host.logger.Infof("created")
+	if record != nil {
+		host.LastPacketProxyName = record.LastProxyName
+		host.LastPacketClientAddr = record.LastClientAddr
+		host.dockerProxies = record.DockerProxies
+
+		if !record.LastPacketDate.IsZero() {
+			host.LastPacketDate = record.LastPacketDate
+		}
+
+		host.logger.Infof("restored state %s, last activity %v ago", host.State.String(), time.Since(host.LastPacketDate).Round(time.Second))
+	}
+
+	host.logger.Infof("created, using the %s driver", host.getDriver().String())
 
 	go host.setupHostLoop()
+	go host.logStateEvents()
+	go host.followDocker()
+	metrics.WatchHost(host.ctx, hostConfig.Name, host.State)
 
-	host.StartHost("Starting proxy")
-	host.LastPacketDate = time.Now()
+	host.applyProxies()
 
 	return host
 }
 
+// restoreState returns a machine in the persisted state of the host, transitional states are
+// restored as the state they started from since the transition did not complete
+func restoreState(record *stateStore.HostRecord) *hostState.Machine {
+	if record == nil {
+		return hostState.NewMachine(hostState.Stopped)
+	}
+
+	state, ok := hostState.ParseState(record.LastState)
+
+	switch {
+	case !ok || state == hostState.Starting:
+		return hostState.NewMachine(hostState.Stopped)
+	case state == hostState.Stopping:
+		return hostState.NewMachine(hostState.Started)
+	default:
+		return hostState.RestoreMachine(state, record.StateChangedAt)
+	}
+}
+
 func (host *Host) setupHostLoop() {
 	host.waitGroup.Add(1)
 	host.logger.Infof("starting host loop")
@@ -78,9 +164,6 @@ func (host *Host) setupHostLoop() {
 	stateTicker := time.NewTicker(1 * time.Second)
 	defer stateTicker.Stop()
 
-	dockerTicker := time.NewTicker(10 * time.Second)
-	defer dockerTicker.Stop()
-
 	inactivityTicker := time.NewTicker(15 * time.Second)
 	defer inactivityTicker.Stop()
 
@@ -88,176 +171,694 @@ func (host *Host) setupHostLoop() {
 		select {
 		case <-stateTicker.C:
 			host.updateState()
-		case <-dockerTicker.C:
+		case <-inactivityTicker.C:
+			host.checkSchedule()
+			host.checkInactivity()
 
-			if host.State == hostState.Started {
-				proxies := host.Config.Proxies
+		case <-host.ctx.Done():
+			// Ensure we break out of the loop if the context is cancelled
 
-				host.logger.Infof("Getting proxies from docker")
+			return
+		}
+	}
+}
 
-				dockerProxies, err := docker.GetProxiesFromDocker(host.Config.SSHUsername, host.Config.Ip, host.Config.SSHPort, host.logger)
+func (host *Host) checkInactivity() {
+	if !host.IsAutostopEnabled() {
+		host.logger.Infof("Autostop is disabled")
+		return
+	}
 
-				if err != nil {
-					host.logger.Errorf("failed to get proxies from docker: %v", err)
-				}
+	timeout := host.GetInactivityTimeout()
+	state := host.State.Get()
 
-				proxies = append(proxies, dockerProxies...)
+	lastPacketDate := host.GetLastActivity().Date
 
-				host.setupProxies(proxies)
-			}
-		case <-inactivityTicker.C:
-			timeout := time.Duration(host.Config.MaxAliveTime) * time.Minute
-			if host.Config.Autostop {
-				if host.State == hostState.Started && time.Since(host.LastPacketDate) > timeout {
-					host.logger.Infof("Host has been inactive for too long, stopping it")
-					go host.StopHost()
-				} else if host.State == hostState.Started {
-					host.logger.Infof("Time remaining before inactivity timeout: %v", timeout-time.Since(host.LastPacketDate).Round(time.Second))
-				} else if host.State == hostState.Stopped {
-					host.logger.Infof("Server stopped since %v", time.Since(host.LastPacketDate.Add(timeout)).Round(time.Second))
-				}
-			} else {
-				host.logger.Infof("Autostop is disabled")
-			}
+	if state == hostState.Started || state == hostState.Stopped {
+		events.Publish(events.HostInactivity, host.GetConfig().Name, &events.InactivityData{
+			State:            state.String(),
+			RemainingSeconds: int((timeout - time.Since(lastPacketDate)).Seconds()),
+		})
+	}
 
-		case <-host.ctx.Done():
-			// Ensure we break out of the loop if the context is cancelled
+	if state == hostState.Started && host.GetSchedule().KeepAwake(time.Now()) {
+		host.logger.Infof("Host is kept awake by its schedule")
+	} else if dependent := host.getAwakeDependent(); state == hostState.Started && dependent != nil {
+		host.logger.Infof("Host is kept awake by %s which depends on it", dependent.GetConfig().Name)
+	} else if state == hostState.Started && time.Since(lastPacketDate) > timeout {
+		host.logger.Infof("Host has been inactive for too long, stopping it")
+		go host.StopHost(hostState.InactivityReason())
+	} else if state == hostState.Started {
+		host.logger.Infof("Time remaining before inactivity timeout: %v", timeout-time.Since(lastPacketDate).Round(time.Second))
+	} else if state == hostState.Stopped {
+		host.logger.Infof("Server stopped since %v", time.Since(lastPacketDate.Add(timeout)).Round(time.Second))
+	}
+}
 
-			return
+// checkSchedule wakes the host when a wake entry was reached since the last check, and stops it during force
+// sleep windows unless an excepted proxy was recently active or an awake host depends on it, like StartHost
+// starts it for a dependent during these windows
+func (host *Host) checkSchedule() {
+	hostSchedule := host.GetSchedule()
+	now := time.Now()
+
+	lastCheck := host.lastScheduleCheck
+	host.lastScheduleCheck = now
+
+	if !lastCheck.IsZero() && hostSchedule.WakeBetween(lastCheck, now) && host.State.Is(hostState.Stopped) {
+		host.logger.Infof("Scheduled wake, starting host")
+		host.resetInactivity()
+		go host.StartHost(hostState.ScheduleReason())
+		return
+	}
+
+	forceSleep, exceptProxies := hostSchedule.ForceSleep(now)
+
+	if forceSleep && host.State.Is(hostState.Started) {
+		if dependent := host.getAwakeDependent(); dependent != nil {
+			host.logger.Debugf("Host is in a force sleep window but %s depends on it", dependent.GetConfig().Name)
+		} else if time.Since(host.getProxiesActivity(exceptProxies)) > host.GetInactivityTimeout() {
+			host.logger.Infof("Host is in a force sleep window, stopping it")
+			go host.StopHost(hostState.ScheduleReason())
 		}
 	}
 }
 
+// GetSchedule returns the schedule of the host, an invalid schedule is logged and replaced by an empty one
+func (host *Host) GetSchedule() *schedule.Schedule {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	if host.schedule != nil && host.scheduleConfig == host.config {
+		return host.schedule
+	}
+
+	hostSchedule, err := schedule.NewSchedule(host.config.Schedules)
+
+	if err != nil {
+		host.logger.Errorf("invalid schedule, ignoring it: %v", err)
+		hostSchedule, _ = schedule.NewSchedule(nil)
+	}
+
+	host.schedule = hostSchedule
+	host.scheduleConfig = host.config
+
+	return hostSchedule
+}
+
 func (host *Host) updateState() {
-	pingSuccess, err := utils.PingIp(host.Config.Ip, 500*time.Millisecond)
+	driver := host.getDriver()
+	pingSuccess, err := driver.Ping()
 
 	if err != nil {
 		host.logger.Errorf("failed to check host status: %v", err)
 		return
 	}
 
-	if host.State == hostState.Started && !pingSuccess {
-		host.State = hostState.Stopped
-	} else if host.State == hostState.Stopped && pingSuccess {
-		host.State = hostState.Started
-	} else if host.State == hostState.Starting && pingSuccess {
-		host.State = hostState.Started
-	} else if host.State == hostState.Stopping && !pingSuccess {
-		host.State = hostState.Stopped
+	state := host.State.Get()
+
+	if (state == hostState.Started || state == hostState.Stopping) && !pingSuccess {
+		host.State.TransitionFrom(state, hostState.Stopped, hostState.PingReason())
+	} else if (state == hostState.Stopped || state == hostState.Starting) && pingSuccess {
+		host.checkReadiness(driver, state)
 	}
+}
+
+// checkReadiness runs the readiness probes off the host loop, since they can be slow, and marks the host as started once they pass.
+// A single check runs at a time, the next ticks are skipped meanwhile
+func (host *Host) checkReadiness(driver hostDriver.HostDriver, state hostState.State) {
+	if !host.readinessChecking.CompareAndSwap(false, true) {
+		return
+	}
+
+	host.waitGroup.Add(1)
+
+	go func() {
+		defer host.waitGroup.Done()
+		defer host.readinessChecking.Store(false)
 
+		if err := driver.CheckReady(); err != nil {
+			host.logger.Debugf("Host answers ping but is not ready: %v", err)
+			return
+		}
+
+		host.State.TransitionFrom(state, hostState.Started, hostState.PingReason())
+	}()
+}
+
+// logStateEvents logs every transition of the host state until the host is disposed
+func (host *Host) logStateEvents() {
+	stateEvents, unsubscribe := host.State.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case event := <-stateEvents:
+			host.logger.Infof("State changed from %s to %s (%s)", event.From.String(), event.To.String(), event.Reason.String())
+
+			events.Publish(events.HostState, host.GetConfig().Name, &events.StateData{
+				From:   event.From.String(),
+				To:     event.To.String(),
+				Reason: event.Reason.String(),
+			})
+
+			stateStore.UpdateHost(host.GetConfig().Name, func(record *stateStore.HostRecord) {
+				record.LastState = event.To.String()
+				record.StateChangedAt = event.Date
+			})
+
+			auditLog.Record(auditLog.NewEntry(host.GetConfig().Name, event))
+		case <-host.ctx.Done():
+			return
+		}
+	}
+}
+
+// followDocker follows the docker events of the host while it is started
+func (host *Host) followDocker() {
+	host.waitGroup.Add(1)
+	defer host.waitGroup.Done()
+
+	stateEvents, unsubscribe := host.State.Subscribe()
+	defer unsubscribe()
+
+	var cancelWatcher context.CancelFunc
+
+	// The stopped watcher is forgotten so that the docker status is not reported while the host is not started
+	stopWatcher := func() {
+		cancelWatcher()
+		cancelWatcher = nil
+
+		host.mutex.Lock()
+		host.dockerWatcher = nil
+		host.mutex.Unlock()
+	}
+
+	update := func() {
+		started := host.State.Is(hostState.Started)
+
+		if started && cancelWatcher == nil {
+			var watcherCtx context.Context
+			watcherCtx, cancelWatcher = context.WithCancel(host.ctx)
+
+			watcher := host.getDriver().NewDiscoverer(host.logger, host.dockerProxiesChanged)
+
+			host.mutex.Lock()
+			host.dockerWatcher = watcher
+			host.mutex.Unlock()
+
+			go watcher.Run(watcherCtx)
+		} else if !started && cancelWatcher != nil {
+			stopWatcher()
+		}
+	}
+
+	update()
+
+	for {
+		select {
+		case <-stateEvents:
+			update()
+		case <-host.ctx.Done():
+			if cancelWatcher != nil {
+				stopWatcher()
+			}
+			return
+		}
+	}
+}
+
+func (host *Host) dockerProxiesChanged(dockerProxies []*config.ProxyConfig) {
+	host.mutex.Lock()
+	host.dockerProxies = dockerProxies
+	host.mutex.Unlock()
+
+	stateStore.UpdateHost(host.GetConfig().Name, func(record *stateStore.HostRecord) {
+		record.DockerProxies = dockerProxies
+	})
+
+	host.applyProxies()
+}
+
+// GetDockerStatus reports whether the docker events are followed and returns the invalid labels of the containers
+func (host *Host) GetDockerStatus() (bool, []*docker.LabelError) {
+	host.mutex.Lock()
+	watcher := host.dockerWatcher
+	host.mutex.Unlock()
+
+	if watcher == nil {
+		return false, []*docker.LabelError{}
+	}
+
+	return watcher.IsConnected(), watcher.GetLabelErrors()
+}
+
+// UpdateConfig replaces the config of the host after a reload and applies its proxies
+func (host *Host) UpdateConfig(hostConfig *config.HostConfig) {
+	host.mutex.Lock()
+	host.config = hostConfig
+	host.mutex.Unlock()
+
+	host.applyProxies()
+}
+
+// applyProxies sets up the proxies of the config and of the containers
+func (host *Host) applyProxies() {
+	host.mutex.Lock()
+	proxyConfigs := append(slices.Clone(host.config.Proxies), host.dockerProxies...)
+	host.mutex.Unlock()
+
+	host.setupProxies(proxyConfigs)
 }
 
 func (host *Host) setupProxies(proxyConfigs []*config.ProxyConfig) {
-	for key := range host.Proxies {
-		exists := slices.ContainsFunc(proxyConfigs, func(proxy *config.ProxyConfig) bool {
-			return proxy.Key == key
+	host.proxiesMutex.Lock()
+	defer host.proxiesMutex.Unlock()
+
+	host.mutex.Lock()
+	existingKeys := slices.Collect(maps.Keys(host.Proxies))
+	host.mutex.Unlock()
+
+	// Listeners being released by listen port and protocol, a new proxy on the same port waits for them
+	released := make(map[string]<-chan struct{})
+
+	for _, key := range existingKeys {
+		proxy := host.getProxy(key)
+
+		if proxy == nil {
+			continue
+		}
+
+		index := slices.IndexFunc(proxyConfigs, func(proxyConfig *config.ProxyConfig) bool {
+			return proxyConfig.Key == key
 		})
 
-		if !exists {
-			host.DisposeProxy(key)
+		if index >= 0 && !proxy.GetConfig().RequiresRestart(proxyConfigs[index]) {
+			continue
+		}
+
+		if index >= 0 {
+			host.logger.Infof("%s: config changed, restarting the proxy", key)
 		}
+
+		released[getListenKey(proxy.GetConfig())], _ = host.DisposeProxy(key)
 	}
 
+	hostConfig := host.GetConfig()
+
 	for _, proxyConfig := range proxyConfigs {
-		if host.Proxies[proxyConfig.Key] != nil {
+		accessList, err := acl.NewList(proxyConfig.Access, hostConfig.Access, hostConfig.DefaultAccess)
+
+		if err != nil {
+			host.logger.Errorf("%s: invalid access list, proxy not set up: %v", proxyConfig.Key, err)
+			continue
+		}
+
+		if proxy := host.getProxy(proxyConfig.Key); proxy != nil {
 			host.logger.Debugf("%s already exists", proxyConfig.Key)
+			proxy.SetAccessList(accessList)
 			continue
 		}
 
-		host.Proxies[proxyConfig.Key] = proxies.NewTCPProxy(&proxies.TCPProxyArgs{
-			HostIp:         host.Config.Ip,
+		if listenerReleased, exists := released[getListenKey(proxyConfig)]; exists {
+			host.logger.Infof("%s: waiting for the previous proxy of the port to release it", proxyConfig.Key)
+			<-listenerReleased
+		}
+
+		proxy, err := proxies.NewProxy(&proxies.ProxyArgs{
+			HostConfig:     hostConfig,
 			ProxyConfig:    proxyConfig,
-			HostState:      &host.State,
+			HostState:      host.State,
 			StartHost:      host.StartHost,
 			PacketReceived: host.PacketReceived,
+			AccessList:     accessList,
+			Driver:         host.getDriver(),
 		}, host.logger)
 
-		go host.Proxies[proxyConfig.Key].Start(&host.waitGroup)
+		if err != nil {
+			host.logger.Errorf("%s: failed to create proxy: %v", proxyConfig.Key, err)
+			continue
+		}
+
+		host.mutex.Lock()
+		host.Proxies[proxyConfig.Key] = proxy
+		host.mutex.Unlock()
+
+		events.Publish(events.ProxyAdded, hostConfig.Name, host.newProxyData(proxyConfig))
+
+		go proxy.Start(&host.waitGroup)
 	}
 }
 
-func (host *Host) StartHost(proxyName string) error {
-	if host.State != hostState.Stopped {
-		host.logger.Infof("Cannot start host, state is not stopped : %s", host.State.String())
+func (host *Host) StartHost(reason hostState.Reason) error {
+	// Dependents wake the host even in a force sleep window, checkSchedule keeps it awake for them
+	if reason.Kind == hostState.ReasonProxy {
+		forceSleep, exceptProxies := host.GetSchedule().ForceSleep(time.Now())
+
+		if forceSleep && !slices.Contains(exceptProxies, reason.Source) {
+			host.logger.Infof("Not starting host for %s, it is in a force sleep window", reason.String())
+			err := fmt.Errorf("host is in a force sleep window")
+			auditLog.Record(auditLog.NewRefusedEntry(host.GetConfig().Name, auditLog.TypeWakeRefused, host.State.Get(), reason, err))
+			return err
+		}
+	}
+
+	if err := host.State.TransitionFrom(hostState.Stopped, hostState.Starting, reason); err != nil {
+		host.logger.Infof("Cannot start host: %v", err)
 		return nil
 	}
 
-	host.State = hostState.Starting
+	if err := host.startDependencies(); err != nil {
+		host.State.TransitionFrom(hostState.Starting, hostState.Stopped, hostState.FailureReason(err))
+		return err
+	}
 
-	if packet, err := newMagicPacket(host.Config.MacAddress); err == nil {
-		packet.send("255.255.255.255")
-		host.logger.Debugf("Sent magic packet to start host")
-	} else {
-		return fmt.Errorf("failed to send magic packet: %v", err)
+	driver := host.getDriver()
+	wakeStrategy, err := driver.Wake()
+
+	if err != nil {
+		err = fmt.Errorf("failed to wake host: %v", err)
+		host.State.TransitionFrom(hostState.Starting, hostState.Stopped, hostState.FailureReason(err))
+		return err
 	}
 
-	err := ntfy.SendNotification("Proxy", fmt.Sprintf("Starting host %s\nRequest coming from %s", host.Config.Name, proxyName), "")
+	host.logger.Debugf("Sent wake request to start host using %s", wakeStrategy)
+
+	err = driver.Notify(fmt.Sprintf("Starting host %s\nRequest coming from %s", host.GetConfig().Name, reason.String()))
 
 	if err != nil {
 		host.logger.Warnf("failed to send notification: %v", err)
 	}
 
-	hostStarted := hostState.WaitForState(&host.State, hostState.Started, 20*time.Second)
+	hostStarted := host.State.WaitFor(hostState.Started, host.GetConfig().GetStartTimeout())
 
 	if !hostStarted {
-		host.State = hostState.Stopped
+		host.State.TransitionFrom(hostState.Starting, hostState.Stopped, hostState.TimeoutReason())
 		return fmt.Errorf("Host took too long to start")
 	} else {
 		return nil
 	}
 }
 
-func (host *Host) StopHost() {
-	if host.State != hostState.Started {
-		host.logger.Infof("Cannot stop host, state is not started : %s", host.State.String())
-		return
+// startDependencies wakes the hosts this host depends on and waits for them to be started
+func (host *Host) startDependencies() error {
+	for _, dependencyName := range host.GetConfig().DependsOn {
+		dependency := host.registry.GetHost(dependencyName)
+
+		if dependency == nil {
+			return fmt.Errorf("dependency %s not found", dependencyName)
+		}
+
+		// Restart the inactivity timeout so the dependency is not stopped before this host is started
+		dependency.resetInactivity()
+
+		if dependency.State.Is(hostState.Started) {
+			continue
+		}
+
+		host.logger.Infof("Starting dependency %s", dependency.GetConfig().Name)
+
+		if err := dependency.StartHost(hostState.DependentReason(host.GetConfig().Name)); err != nil {
+			return fmt.Errorf("failed to start dependency %s: %v", dependency.GetConfig().Name, err)
+		}
+
+		if !dependency.State.WaitFor(hostState.Started, dependency.GetConfig().GetStartTimeout()) {
+			return fmt.Errorf("dependency %s took too long to start", dependency.GetConfig().Name)
+		}
 	}
 
-	host.State = hostState.Stopping
+	return nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// getAwakeDependent returns a starting or started host depending on this host, or nil
+func (host *Host) getAwakeDependent() *Host {
+	for _, other := range host.registry.GetHosts() {
+		if !other.State.Is(hostState.Starting, hostState.Started) {
+			continue
+		}
 
-	go func() {
-		err := sendSSHCommand(ctx, host.Config, "sudo pm-suspend &")
+		dependsOnHost := slices.ContainsFunc(other.GetConfig().DependsOn, func(name string) bool {
+			return strings.EqualFold(name, host.GetConfig().Name)
+		})
 
-		if err != nil {
-			host.logger.Errorf("failed to stop host: %v", err)
+		if dependsOnHost {
+			return other
 		}
-	}()
+	}
+
+	return nil
+}
+
+func (host *Host) StopHost(reason hostState.Reason) error {
+	if !host.State.Is(hostState.Started) {
+		host.logger.Infof("Cannot stop host, state is not started : %s", host.State.String())
+		return nil
+	}
 
-	err := ntfy.SendNotification("Proxy", fmt.Sprintf("Stopping host %s", host.Config.Name), "")
+	driver := host.getDriver()
+
+	if err := driver.PreSleep(); err != nil {
+		host.logger.Infof("Pre sleep hook refused to stop host: %v", err)
+		auditLog.Record(auditLog.NewRefusedEntry(host.GetConfig().Name, auditLog.TypeSleepRefused, hostState.Started, reason, err))
+		return fmt.Errorf("pre sleep hook refused to stop host: %v", err)
+	}
+
+	if err := host.State.TransitionFrom(hostState.Started, hostState.Stopping, reason); err != nil {
+		host.logger.Infof("Cannot stop host: %v", err)
+		return nil
+	}
+
+	result := driver.Sleep()
+	host.mutex.Lock()
+	host.lastSleepResult = result
+	host.mutex.Unlock()
+
+	if !result.Success() {
+		host.logger.Errorf("failed to stop host using %s: %s, output: %s", result.Strategy, result.Error, result.Output)
+		host.State.TransitionFrom(hostState.Stopping, hostState.Started, hostState.FailureReason(errors.New(result.Error)))
+		return fmt.Errorf("failed to stop host: %s", result.Error)
+	}
+
+	host.logger.Infof("Sleep request sent using %s, output: %s", result.Strategy, result.Output)
+
+	err := driver.Notify(fmt.Sprintf("Stopping host %s", host.GetConfig().Name))
 
 	if err != nil {
 		host.logger.Warnf("failed to send notification: %v", err)
 	}
 
-	hostStopped := hostState.WaitForState(&host.State, hostState.Stopped, 20*time.Second)
+	hostStopped := host.State.WaitFor(hostState.Stopped, host.GetConfig().GetStopTimeout())
 
 	if !hostStopped {
-		host.State = hostState.Started
+		host.State.TransitionFrom(hostState.Stopping, hostState.Started, hostState.TimeoutReason())
 		host.logger.Errorf("Host took too long to stop")
+		return fmt.Errorf("Host took too long to stop")
 	}
+
+	return nil
+}
+
+// GetConfig returns the current config of the host, it is replaced and never modified so the snapshot can be kept
+func (host *Host) GetConfig() *config.HostConfig {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	return host.config
+}
+
+// getDriver returns the driver of the current config of the host
+func (host *Host) getDriver() hostDriver.HostDriver {
+	return hostDriver.NewDriver(host.GetConfig())
+}
+
+// GetLastSleepResult returns the result of the last sleep request, or nil when the host has not been stopped yet
+func (host *Host) GetLastSleepResult() *power.SleepResult {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	return host.lastSleepResult
 }
 
-func (host *Host) PacketReceived(proxyName string) {
+// PacketReceived is called by the proxies when traffic counts as activity according to their activity rules
+func (host *Host) PacketReceived(proxyName string, clientAddr string) {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
 	host.LastPacketDate = time.Now()
 	host.LastPacketProxyName = proxyName
+	host.LastPacketClientAddr = clientAddr
+
+	host.proxyActivity[proxyName] = Activity{
+		Date:       host.LastPacketDate,
+		ProxyName:  proxyName,
+		ClientAddr: clientAddr,
+	}
+
+	stateStore.UpdateHost(host.config.Name, func(record *stateStore.HostRecord) {
+		record.LastPacketDate = host.LastPacketDate
+		record.LastProxyName = proxyName
+		record.LastClientAddr = clientAddr
+	})
+}
+
+// resetInactivity restarts the inactivity timeout without attributing the activity to a proxy
+func (host *Host) resetInactivity() {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	host.LastPacketDate = time.Now()
+	host.LastPacketProxyName = ""
+	host.LastPacketClientAddr = ""
+
+	stateStore.UpdateHost(host.config.Name, func(record *stateStore.HostRecord) {
+		record.LastPacketDate = host.LastPacketDate
+		record.LastProxyName = ""
+		record.LastClientAddr = ""
+	})
+}
+
+// getProxiesActivity returns the date of the last packet received by one of the proxies
+func (host *Host) getProxiesActivity(proxyNames []string) time.Time {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	lastActivity := time.Time{}
+
+	for _, proxyName := range proxyNames {
+		if activity := host.proxyActivity[proxyName]; activity.Date.After(lastActivity) {
+			lastActivity = activity.Date
+		}
+	}
+
+	return lastActivity
 }
 
-func (host *Host) DisposeProxy(proxyName string) {
+// GetLastActivity returns the last activity of the host, which is the one keeping it awake
+func (host *Host) GetLastActivity() Activity {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	return Activity{
+		Date:       host.LastPacketDate,
+		ProxyName:  host.LastPacketProxyName,
+		ClientAddr: host.LastPacketClientAddr,
+	}
+}
+
+// GetProxiesActivity returns the last activity of each proxy, sorted from the most recent
+func (host *Host) GetProxiesActivity() []Activity {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	activities := slices.Collect(maps.Values(host.proxyActivity))
+
+	slices.SortFunc(activities, func(a, b Activity) int {
+		return b.Date.Compare(a.Date)
+	})
+
+	return activities
+}
+
+func (host *Host) IsAutostopEnabled() bool {
+	return host.GetConfig().Autostop
+}
+
+// SetAutostop writes the autostop to the config file, it is applied right away instead of waiting for the reload
+func (host *Host) SetAutostop(enabled bool) error {
+	if err := config.SetHostFields(host.GetConfig().Name, map[string]any{"autostop": enabled}); err != nil {
+		return err
+	}
+
+	host.mutex.Lock()
+	hostConfig := *host.config
+	hostConfig.Autostop = enabled
+	host.config = &hostConfig
+	host.mutex.Unlock()
+
+	return nil
+}
+
+func (host *Host) GetInactivityTimeout() time.Duration {
+	return time.Duration(host.GetConfig().MaxAliveTime) * time.Minute
+}
+
+// GetProxyConfigs returns the configs of the running proxies, sorted by key
+func (host *Host) GetProxyConfigs() []*config.ProxyConfig {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	proxyConfigs := []*config.ProxyConfig{}
+
+	for _, proxy := range host.Proxies {
+		proxyConfigs = append(proxyConfigs, proxy.GetConfig())
+	}
+
+	slices.SortFunc(proxyConfigs, func(a, b *config.ProxyConfig) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return proxyConfigs
+}
+
+func (host *Host) newProxyData(proxyConfig *config.ProxyConfig) *events.ProxyData {
+	source := "docker"
+	if slices.Contains(host.GetConfig().Proxies, proxyConfig) {
+		source = "config"
+	}
+
+	return &events.ProxyData{
+		Key:        proxyConfig.Key,
+		Name:       proxyConfig.Name,
+		Protocol:   proxyConfig.Protocol,
+		ListenPort: proxyConfig.ListenPort,
+		ServerPort: proxyConfig.ServerPort,
+		Source:     source,
+	}
+}
+
+func (host *Host) getProxy(key string) proxies.Proxy {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	return host.Proxies[key]
+}
+
+func getListenKey(proxyConfig *config.ProxyConfig) string {
+	return fmt.Sprintf("%d/%s", proxyConfig.ListenPort, proxyConfig.Protocol)
+}
+
+// DisposeProxy removes the proxy, its open connections are drained in the background.
+// The released channel is closed once its listen port is free, the stopped channel once the proxy is stopped
+func (host *Host) DisposeProxy(proxyName string) (released <-chan struct{}, stopped <-chan struct{}) {
+	done := make(chan struct{})
+
+	host.mutex.Lock()
 	proxy := host.Proxies[proxyName]
+	delete(host.Proxies, proxyName)
+	host.mutex.Unlock()
 
 	if proxy == nil {
 		host.logger.Errorf("%s: proxy does not exist", proxyName)
-		return
+		close(done)
+		return done, done
 	}
 
-	proxy.Stop()
-	delete(host.Proxies, proxyName)
+	events.Publish(events.ProxyRemoved, host.GetConfig().Name, host.newProxyData(proxy.GetConfig()))
+
+	go func() {
+		defer close(done)
+
+		proxy.Stop(config.Config.DrainTimeout)
 
-	host.logger.Infof("%s: disposed", proxyName)
+		// A proxy restarted with a new config keeps the key and its metrics
+		if host.getProxy(proxyName) == nil {
+			metrics.ForgetProxy(host.GetConfig().Name, proxyName)
+		}
+
+		host.logger.Infof("%s: disposed", proxyName)
+	}()
+
+	return proxy.ListenerReleased(), done
 }
 
 func (host *Host) Dispose() {
@@ -265,8 +866,19 @@ func (host *Host) Dispose() {
 
 	host.cancel()
 
-	for name := range host.Proxies {
-		host.DisposeProxy(name)
+	host.mutex.Lock()
+	proxyNames := slices.Collect(maps.Keys(host.Proxies))
+	host.mutex.Unlock()
+
+	stoppedProxies := []<-chan struct{}{}
+
+	for _, name := range proxyNames {
+		_, stopped := host.DisposeProxy(name)
+		stoppedProxies = append(stoppedProxies, stopped)
+	}
+
+	for _, stopped := range stoppedProxies {
+		<-stopped
 	}
 
 	host.waitGroup.Wait()
@@ -0,0 +1,431 @@
+package host
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/auditLog"
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostDriver"
+	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/schedule"
+)
+
+// Long enough for the simulated boot or sleep and the next ticks of the host loop
+const stateTimeout = 5 * time.Second
+
+type testRegistry struct {
+	hosts []*Host
+}
+
+func (registry *testRegistry) GetHost(name string) *Host {
+	for _, host := range registry.hosts {
+		if host.GetConfig().Name == name {
+			return host
+		}
+	}
+
+	return nil
+}
+
+func (registry *testRegistry) GetHosts() []*Host {
+	return registry.hosts
+}
+
+func TestMain(m *testing.M) {
+	logger.InitAppLogger("")
+
+	dir, err := os.MkdirTemp("", "go-proxy-host")
+	if err != nil {
+		panic(err)
+	}
+
+	config.Config = &config.AppEnvConfig{
+		StateFilePath:  filepath.Join(dir, "state.json"),
+		AuditLogPath:   filepath.Join(dir, "audit.jsonl"),
+		AuditRetention: time.Hour,
+		DrainTimeout:   time.Second,
+	}
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newSimulatedHost creates a host using the simulator driver, its name is made unique since the
+// simulated machines and the saved states are kept by name across the runs of the tests
+func newSimulatedHost(t *testing.T, hostConfig *config.HostConfig) *Host {
+	t.Helper()
+
+	hostConfig.Name = fmt.Sprintf("%s-%d", hostConfig.Name, time.Now().UnixNano())
+	hostConfig.Driver.Type = hostDriver.TypeSimulator
+	hostConfig.Driver.BootDelay = 1
+	hostConfig.Driver.SleepDelay = 1
+
+	registry := &testRegistry{}
+	host := NewHost(hostConfig, registry)
+	registry.hosts = append(registry.hosts, host)
+
+	t.Cleanup(host.Dispose)
+
+	return host
+}
+
+// getFreePort returns a tcp port free at the time of the call
+func getFreePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startEchoServer starts the server of the simulated machine on the ip of the simulator driver
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the echo server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestProxyWakeReachesStarted(t *testing.T) {
+	proxyConfig := &config.ProxyConfig{
+		Name:       "echo",
+		Protocol:   config.ProtocolTCP,
+		ListenPort: getFreePort(t),
+		ServerPort: startEchoServer(t),
+	}
+	proxyConfig.Key = config.GetProxyKey(proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.Protocol)
+
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:         "test-proxy-wake",
+		MaxAliveTime: 10,
+		Driver:       &config.DriverConfig{},
+		Proxies:      []*config.ProxyConfig{proxyConfig},
+	})
+
+	if !host.State.Is(hostState.Stopped) {
+		t.Fatalf("expected the host to be stopped, got %s", host.State.String())
+	}
+
+	var conn net.Conn
+	var err error
+
+	// The proxy starts listening in the background
+	for deadline := time.Now().Add(stateTimeout); ; time.Sleep(50 * time.Millisecond) {
+		conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyConfig.ListenPort)))
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to the proxy: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(stateTimeout))
+	response := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read the response of the server: %v", err)
+	}
+
+	if string(response) != "ping" {
+		t.Errorf("expected the echo of the server, got %q", response)
+	}
+
+	if !host.State.Is(hostState.Started) {
+		t.Errorf("expected the host to be started, got %s", host.State.String())
+	}
+}
+
+func TestAutostopPutsHostToSleep(t *testing.T) {
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:     "test-autostop",
+		Autostop: true,
+		// No inactivity allowed, the next check stops the host
+		MaxAliveTime: 0,
+		Driver:       &config.DriverConfig{StartAwake: true},
+	})
+
+	if !host.State.WaitFor(hostState.Started, stateTimeout) {
+		t.Fatalf("expected the awake machine to be started, got %s", host.State.String())
+	}
+
+	host.checkInactivity()
+
+	if !host.State.WaitFor(hostState.Stopped, stateTimeout) {
+		t.Fatalf("expected the host to be stopped by the autostop, got %s", host.State.String())
+	}
+
+	if result := host.GetLastSleepResult(); result == nil || !result.Success() {
+		t.Errorf("expected a successful sleep result, got %+v", result)
+	}
+}
+
+func TestSleepFailureRollsBackToStarted(t *testing.T) {
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:         "test-sleep-failure",
+		MaxAliveTime: 10,
+		Driver:       &config.DriverConfig{StartAwake: true, SleepFailureRate: 1},
+	})
+
+	if !host.State.WaitFor(hostState.Started, stateTimeout) {
+		t.Fatalf("expected the awake machine to be started, got %s", host.State.String())
+	}
+
+	transitions, unsubscribe := host.State.Subscribe()
+	defer unsubscribe()
+
+	if err := host.StopHost(hostState.ApiReason()); err == nil {
+		t.Fatalf("expected the simulated sleep failure to be returned")
+	}
+
+	if !host.State.Is(hostState.Started) {
+		t.Errorf("expected the host to be back to started, got %s", host.State.String())
+	}
+
+	expected := []hostState.State{hostState.Stopping, hostState.Started}
+
+	for _, state := range expected {
+		select {
+		case event := <-transitions:
+			if event.To != state {
+				t.Errorf("expected a transition to %s, got %s", state, event.To)
+			}
+		case <-time.After(stateTimeout):
+			t.Fatalf("expected a transition to %s", state)
+		}
+	}
+
+	if result := host.GetLastSleepResult(); result == nil || result.Success() {
+		t.Errorf("expected a failed sleep result, got %+v", result)
+	}
+}
+
+// startGreetingServer starts a server sending the greeting to every client
+func startGreetingServer(t *testing.T, greeting string) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the greeting server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// readGreeting connects to the proxy until it listens and returns the first byte sent by the server
+func readGreeting(t *testing.T, listenPort int) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(stateTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)))
+		if err != nil {
+			continue
+		}
+
+		// The proxy waits for the first data of the client before connecting to the server
+		conn.Write([]byte("hello"))
+		conn.SetReadDeadline(time.Now().Add(stateTimeout))
+		greeting := make([]byte, 1)
+		_, err = io.ReadFull(conn, greeting)
+		conn.Close()
+
+		if err == nil {
+			return string(greeting)
+		}
+	}
+
+	t.Fatalf("no greeting received from the proxy")
+	return ""
+}
+
+func TestReloadRestartsChangedProxy(t *testing.T) {
+	proxyConfig := &config.ProxyConfig{
+		Name:       "greeting",
+		Protocol:   config.ProtocolTCP,
+		ListenPort: getFreePort(t),
+		ServerPort: startGreetingServer(t, "a"),
+	}
+	proxyConfig.Key = config.GetProxyKey(proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.Protocol)
+
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:         "test-reload",
+		MaxAliveTime: 10,
+		Driver:       &config.DriverConfig{StartAwake: true},
+		Proxies:      []*config.ProxyConfig{proxyConfig},
+	})
+
+	if !host.State.WaitFor(hostState.Started, stateTimeout) {
+		t.Fatalf("expected the awake machine to be started, got %s", host.State.String())
+	}
+
+	if greeting := readGreeting(t, proxyConfig.ListenPort); greeting != "a" {
+		t.Fatalf("expected the greeting of the first server, got %q", greeting)
+	}
+
+	changedProxy := *proxyConfig
+	changedProxy.ServerPort = startGreetingServer(t, "b")
+
+	changedHost := *host.GetConfig()
+	changedHost.Proxies = []*config.ProxyConfig{&changedProxy}
+
+	host.UpdateConfig(&changedHost)
+
+	if greeting := readGreeting(t, proxyConfig.ListenPort); greeting != "b" {
+		t.Errorf("expected the greeting of the server of the reloaded config, got %q", greeting)
+	}
+}
+
+func TestForceSleepRefusalIsAudited(t *testing.T) {
+	now := time.Now()
+
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:         "test-wake-refused",
+		MaxAliveTime: 10,
+		Driver:       &config.DriverConfig{},
+		Schedules: []*config.ScheduleConfig{{
+			Type: schedule.TypeForceSleep,
+			From: now.Add(-time.Hour).Format("15:04"),
+			To:   now.Add(time.Hour).Format("15:04"),
+		}},
+	})
+
+	if err := host.StartHost(hostState.ProxyReason("web", "192.0.2.1:1234")); err == nil {
+		t.Fatalf("expected the wake to be refused in the force sleep window")
+	}
+
+	history := auditLog.GetHistory(host.GetConfig().Name, now.Add(-time.Minute))
+
+	if len(history) != 1 || history[0].Type != auditLog.TypeWakeRefused || history[0].ProxyName != "web" {
+		t.Errorf("expected a refused wake of the proxy in the audit log, got %+v", history)
+	}
+}
+
+// startUDPEchoServer starts an udp server sending back every datagram
+func startUDPEchoServer(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start the udp echo server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1024)
+
+		for {
+			bytesRead, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			conn.WriteToUDP(buffer[:bytesRead], clientAddr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPDrainEndsOnceSessionsAreIdle(t *testing.T) {
+	proxyConfig := &config.ProxyConfig{
+		Name:       "udp-echo",
+		Protocol:   config.ProtocolUDP,
+		ListenPort: getFreePort(t),
+		ServerPort: startUDPEchoServer(t),
+	}
+	proxyConfig.Key = config.GetProxyKey(proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.Protocol)
+
+	host := newSimulatedHost(t, &config.HostConfig{
+		Name:         "test-udp-drain",
+		MaxAliveTime: 10,
+		Driver:       &config.DriverConfig{StartAwake: true},
+		Proxies:      []*config.ProxyConfig{proxyConfig},
+	})
+
+	if !host.State.WaitFor(hostState.Started, stateTimeout) {
+		t.Fatalf("expected the awake machine to be started, got %s", host.State.String())
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyConfig.ListenPort)))
+	if err != nil {
+		t.Fatalf("failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+
+	response := make([]byte, 4)
+
+	// The proxy starts listening in the background, the datagrams sent before are lost
+	for deadline := time.Now().Add(stateTimeout); ; {
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+		if _, err = conn.Read(response); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("failed to read the response of the server: %v", err)
+	}
+
+	start := time.Now()
+	// Shorter than the session timeout, the drain would last until its timeout if it waited for the session to expire
+	host.getProxy(proxyConfig.Key).Stop(30 * time.Second)
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the drain to end once the session was idle, took %s", elapsed)
+	}
+}
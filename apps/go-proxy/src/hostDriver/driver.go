@@ -0,0 +1,67 @@
+package hostDriver
+
+import (
+	"context"
+	"strings"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/docker"
+	"mgarnier11.fr/go/go-proxy/power"
+	"mgarnier11.fr/go/go-proxy/probe"
+)
+
+const (
+	TypeMachine   = "machine"
+	TypeSimulator = "simulator"
+)
+
+// HostDriver controls the machine of a host, it probes its state, wakes it, puts it to sleep and discovers its proxies
+type HostDriver interface {
+	// Ping reports whether the machine answers
+	Ping() (bool, error)
+	// CheckReady returns an error while the services of a machine answering the ping are not ready
+	CheckReady() error
+	// Wake sends the wake request and returns the strategy used, it does not wait for the machine to be started
+	Wake() (string, error)
+	// PreSleep returns an error when the machine must not be put to sleep
+	PreSleep() error
+	// Sleep sends the sleep request, it does not wait for the machine to be stopped
+	Sleep() *power.SleepResult
+	// NewDiscoverer returns the discoverer of the proxies of the machine, onChange is called with every proxy found
+	NewDiscoverer(logger *logger.Logger, onChange func(proxies []*config.ProxyConfig)) Discoverer
+	// ServerIp returns the ip the proxies forward to
+	ServerIp() string
+	// NewReadinessProbe returns the readiness probe of a proxy, defaultPort is used by tcp probes without port
+	NewReadinessProbe(probeConfig *config.ProbeConfig, defaultPort int) (probe.Probe, error)
+	// Notify sends a notification about the machine
+	Notify(message string) error
+	String() string
+}
+
+// Discoverer follows the proxies of a started machine
+type Discoverer interface {
+	// Run follows the proxies until the context is done
+	Run(ctx context.Context)
+	IsConnected() bool
+	GetLabelErrors() []*docker.LabelError
+}
+
+// NewDriver returns the driver configured for the host, every host is simulated in demo mode
+func NewDriver(hostConfig *config.HostConfig) HostDriver {
+	if IsSimulated(hostConfig) {
+		return newSimulatorDriver(hostConfig)
+	}
+
+	return &machineDriver{hostConfig: hostConfig}
+}
+
+// IsSimulated reports whether the host uses the simulator driver
+func IsSimulated(hostConfig *config.HostConfig) bool {
+	if config.Config.DemoMode {
+		return true
+	}
+
+	return hostConfig.Driver != nil && strings.ToLower(hostConfig.Driver.Type) == TypeSimulator
+}
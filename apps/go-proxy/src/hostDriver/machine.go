@@ -0,0 +1,83 @@
+package hostDriver
+
+import (
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+	"mgarnier11.fr/go/libs/ntfy"
+	"mgarnier11.fr/go/libs/utils"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/docker"
+	"mgarnier11.fr/go/go-proxy/power"
+	"mgarnier11.fr/go/go-proxy/probe"
+)
+
+const pingTimeout = 500 * time.Millisecond
+
+// machineDriver controls a real machine with ping, the wake and sleep strategies of its config and docker
+type machineDriver struct {
+	hostConfig *config.HostConfig
+}
+
+func (driver *machineDriver) Ping() (bool, error) {
+	return utils.PingIp(driver.hostConfig.Ip, pingTimeout)
+}
+
+func (driver *machineDriver) CheckReady() error {
+	return probe.CheckHost(driver.hostConfig)
+}
+
+func (driver *machineDriver) Wake() (string, error) {
+	wakeStrategy, err := power.NewWakeStrategy(driver.hostConfig)
+
+	if err != nil {
+		return "", err
+	}
+
+	return wakeStrategy.String(), wakeStrategy.Wake()
+}
+
+func (driver *machineDriver) PreSleep() error {
+	return power.RunPreSleepHooks(driver.hostConfig)
+}
+
+func (driver *machineDriver) Sleep() *power.SleepResult {
+	result := &power.SleepResult{Date: time.Now()}
+
+	sleepStrategy, err := power.NewSleepStrategy(driver.hostConfig)
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Strategy = sleepStrategy.String()
+	result.Output, err = sleepStrategy.Sleep()
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func (driver *machineDriver) NewDiscoverer(logger *logger.Logger, onChange func(proxies []*config.ProxyConfig)) Discoverer {
+	return docker.NewWatcher(driver.hostConfig, logger, onChange)
+}
+
+func (driver *machineDriver) ServerIp() string {
+	return driver.hostConfig.Ip
+}
+
+func (driver *machineDriver) NewReadinessProbe(probeConfig *config.ProbeConfig, defaultPort int) (probe.Probe, error) {
+	return probe.NewProbe(probeConfig, driver.hostConfig, defaultPort)
+}
+
+func (driver *machineDriver) Notify(message string) error {
+	return ntfy.SendNotification("Proxy", message, "")
+}
+
+func (driver *machineDriver) String() string {
+	return TypeMachine
+}
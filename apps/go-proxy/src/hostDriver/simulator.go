@@ -0,0 +1,240 @@
+package hostDriver
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/docker"
+	"mgarnier11.fr/go/go-proxy/power"
+	"mgarnier11.fr/go/go-proxy/probe"
+)
+
+const (
+	defaultBootDelay  = 5 * time.Second
+	defaultSleepDelay = 3 * time.Second
+	defaultServerIp   = "127.0.0.1"
+)
+
+type machineState int
+
+const (
+	machineAsleep machineState = iota
+	machineBooting
+	machineAwake
+	machineFallingAsleep
+)
+
+// simulatedMachine is the fake machine of a host, it boots and falls asleep after the delays of the driver config
+type simulatedMachine struct {
+	state machineState
+	// End of the boot or of the fall asleep
+	until time.Time
+	mutex sync.Mutex
+}
+
+// Machines by lowercase host name, kept across config reloads
+var (
+	simulatedMachines      = make(map[string]*simulatedMachine)
+	simulatedMachinesMutex sync.Mutex
+)
+
+func getSimulatedMachine(hostConfig *config.HostConfig, driverConfig *config.DriverConfig) *simulatedMachine {
+	simulatedMachinesMutex.Lock()
+	defer simulatedMachinesMutex.Unlock()
+
+	name := strings.ToLower(hostConfig.Name)
+	machine, exists := simulatedMachines[name]
+
+	if !exists {
+		machine = &simulatedMachine{state: machineAsleep}
+
+		if driverConfig.StartAwake {
+			machine.state = machineAwake
+		}
+
+		simulatedMachines[name] = machine
+	}
+
+	return machine
+}
+
+// update ends the boot or the fall asleep once its delay elapsed, the mutex must be held
+func (machine *simulatedMachine) update(now time.Time) {
+	if now.Before(machine.until) {
+		return
+	}
+
+	switch machine.state {
+	case machineBooting:
+		machine.state = machineAwake
+	case machineFallingAsleep:
+		machine.state = machineAsleep
+	}
+}
+
+// simulatorDriver fakes the machine of a host, to run go-proxy without real machines
+type simulatorDriver struct {
+	machine    *simulatedMachine
+	bootDelay  time.Duration
+	sleepDelay time.Duration
+	serverIp   string
+	// Probability of a wake request being ignored and of a sleep request failing
+	wakeFailureRate  float64
+	sleepFailureRate float64
+}
+
+func newSimulatorDriver(hostConfig *config.HostConfig) *simulatorDriver {
+	driverConfig := hostConfig.Driver
+
+	if driverConfig == nil {
+		driverConfig = &config.DriverConfig{}
+	}
+
+	driver := &simulatorDriver{
+		machine:          getSimulatedMachine(hostConfig, driverConfig),
+		bootDelay:        time.Duration(driverConfig.BootDelay) * time.Second,
+		sleepDelay:       time.Duration(driverConfig.SleepDelay) * time.Second,
+		serverIp:         driverConfig.ServerIp,
+		wakeFailureRate:  driverConfig.WakeFailureRate,
+		sleepFailureRate: driverConfig.SleepFailureRate,
+	}
+
+	if driver.bootDelay <= 0 {
+		driver.bootDelay = defaultBootDelay
+	}
+
+	if driver.sleepDelay <= 0 {
+		driver.sleepDelay = defaultSleepDelay
+	}
+
+	if driver.serverIp == "" {
+		driver.serverIp = defaultServerIp
+	}
+
+	return driver
+}
+
+// Ping answers while the machine is awake, and while it falls asleep like a machine shutting down
+func (driver *simulatorDriver) Ping() (bool, error) {
+	driver.machine.mutex.Lock()
+	defer driver.machine.mutex.Unlock()
+
+	driver.machine.update(time.Now())
+
+	return driver.machine.state == machineAwake || driver.machine.state == machineFallingAsleep, nil
+}
+
+func (driver *simulatorDriver) CheckReady() error {
+	return nil
+}
+
+// Wake starts the boot of an asleep machine, a failed wake is silent like a lost wake-on-lan packet
+func (driver *simulatorDriver) Wake() (string, error) {
+	driver.machine.mutex.Lock()
+	defer driver.machine.mutex.Unlock()
+
+	now := time.Now()
+	driver.machine.update(now)
+
+	if rand.Float64() < driver.wakeFailureRate {
+		return driver.String(), nil
+	}
+
+	switch driver.machine.state {
+	case machineAsleep:
+		driver.machine.state = machineBooting
+		driver.machine.until = now.Add(driver.bootDelay)
+	case machineFallingAsleep:
+		// Boots once asleep
+		driver.machine.state = machineBooting
+		driver.machine.until = driver.machine.until.Add(driver.bootDelay)
+	}
+
+	return driver.String(), nil
+}
+
+func (driver *simulatorDriver) PreSleep() error {
+	return nil
+}
+
+func (driver *simulatorDriver) Sleep() *power.SleepResult {
+	result := &power.SleepResult{Date: time.Now(), Strategy: driver.String()}
+
+	driver.machine.mutex.Lock()
+	defer driver.machine.mutex.Unlock()
+
+	driver.machine.update(result.Date)
+
+	if rand.Float64() < driver.sleepFailureRate {
+		result.Error = "simulated sleep failure"
+		return result
+	}
+
+	if driver.machine.state == machineAwake {
+		driver.machine.state = machineFallingAsleep
+		driver.machine.until = result.Date.Add(driver.sleepDelay)
+	}
+
+	result.Output = "simulated sleep"
+
+	return result
+}
+
+func (driver *simulatorDriver) NewDiscoverer(logger *logger.Logger, onChange func(proxies []*config.ProxyConfig)) Discoverer {
+	return &simulatedDiscoverer{}
+}
+
+// ServerIp returns a local ip, the proxies of the simulated machine must not reach the real machine
+func (driver *simulatorDriver) ServerIp() string {
+	return driver.serverIp
+}
+
+// NewReadinessProbe returns no probe, the services of the simulated machine are ready once it is awake like with CheckReady
+func (driver *simulatorDriver) NewReadinessProbe(probeConfig *config.ProbeConfig, defaultPort int) (probe.Probe, error) {
+	return nil, nil
+}
+
+// Notify sends nothing, the simulated machines must not notify the real subscribers
+func (driver *simulatorDriver) Notify(message string) error {
+	return nil
+}
+
+func (driver *simulatorDriver) String() string {
+	return TypeSimulator
+}
+
+// simulatedDiscoverer finds no proxy, the simulated machine runs no container
+type simulatedDiscoverer struct {
+	connected bool
+	mutex     sync.Mutex
+}
+
+func (discoverer *simulatedDiscoverer) Run(ctx context.Context) {
+	discoverer.setConnected(true)
+	<-ctx.Done()
+	discoverer.setConnected(false)
+}
+
+func (discoverer *simulatedDiscoverer) setConnected(connected bool) {
+	discoverer.mutex.Lock()
+	defer discoverer.mutex.Unlock()
+
+	discoverer.connected = connected
+}
+
+func (discoverer *simulatedDiscoverer) IsConnected() bool {
+	discoverer.mutex.Lock()
+	defer discoverer.mutex.Unlock()
+
+	return discoverer.connected
+}
+
+func (discoverer *simulatedDiscoverer) GetLabelErrors() []*docker.LabelError {
+	return []*docker.LabelError{}
+}
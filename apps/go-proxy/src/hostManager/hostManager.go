@@ -1,58 +1,126 @@
 package hostManager
 
 import (
+	"maps"
 	"slices"
 	"strings"
+	"sync"
 
 	"mgarnier11.fr/go/libs/logger"
 
 	"mgarnier11.fr/go/go-proxy/config"
 	"mgarnier11.fr/go/go-proxy/host"
+	"mgarnier11.fr/go/go-proxy/hostState"
 )
 
 var hosts map[string]*host.Host = make(map[string]*host.Host)
 
-func GetHosts() *(map[string]*host.Host) {
-	return &hosts
+// Protects hosts, which is only modified by ConfigFileChanged
+var hostsMutex sync.RWMutex
+
+// GetHosts returns a copy of the hosts, safe to iterate while the config is reloaded
+func GetHosts() []*host.Host {
+	hostsMutex.RLock()
+	defer hostsMutex.RUnlock()
+
+	return slices.Collect(maps.Values(hosts))
 }
 
 func GetHost(name string) *host.Host {
 	hostKey := strings.ToUpper(name)
 
+	hostsMutex.RLock()
+	defer hostsMutex.RUnlock()
+
 	return hosts[hostKey]
 }
 
 func setHost(name string, host *host.Host) {
 	hostKey := strings.ToUpper(name)
 
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
 	hosts[hostKey] = host
 }
 
+// registry exposes the hosts of the manager to the hosts themselves, for their dependencies
+type registry struct{}
+
+func (registry) GetHost(name string) *host.Host {
+	return GetHost(name)
+}
+
+func (registry) GetHosts() []*host.Host {
+	return GetHosts()
+}
+
 func ConfigFileChanged(configFile *config.AppConfigFile) {
 	logger.Infof("Config file changed")
 
+	removedHosts := []*host.Host{}
+
+	hostsMutex.Lock()
 	for hostKey, hostValue := range hosts {
 		exists := slices.ContainsFunc(configFile.ProxyHosts, func(hostConfig *config.HostConfig) bool {
 			return strings.ToUpper(hostConfig.Name) == hostKey
 		})
 
 		if !exists {
-			logger.Infof("%s not found in updated config file, destroying it", hostValue.Config.Name)
-
-			hostValue.Dispose()
+			logger.Infof("%s not found in updated config file, destroying it", hostValue.GetConfig().Name)
 
+			removedHosts = append(removedHosts, hostValue)
 			delete(hosts, hostKey)
 		}
 	}
+	hostsMutex.Unlock()
+
+	disposeHosts(removedHosts)
+
+	newHosts := []*host.Host{}
 
 	for _, hostConfig := range configFile.ProxyHosts {
 		hostValue := GetHost(hostConfig.Name)
 
 		if hostValue == nil {
-			hostValue = host.NewHost(hostConfig)
+			hostValue = host.NewHost(hostConfig, registry{})
 			setHost(hostConfig.Name, hostValue)
+			newHosts = append(newHosts, hostValue)
 		} else {
-			hostValue.Config = hostConfig
+			hostValue.UpdateConfig(hostConfig)
 		}
 	}
+
+	// Woken once every host exists, so that their dependencies can be found
+	for _, hostValue := range newHosts {
+		if hostValue.GetConfig().WakeOnStartup {
+			go hostValue.StartHost(hostState.StartupReason())
+		}
+	}
+}
+
+// disposeHosts disposes the hosts concurrently, their connections being drained at the same time
+func disposeHosts(hostsToDispose []*host.Host) {
+	var waitGroup sync.WaitGroup
+
+	for _, hostValue := range hostsToDispose {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			hostValue.Dispose()
+		}()
+	}
+
+	waitGroup.Wait()
+}
+
+// Shutdown disposes every host, it returns once their connections are drained
+func Shutdown() {
+	hostsMutex.Lock()
+	allHosts := slices.Collect(maps.Values(hosts))
+	hosts = make(map[string]*host.Host)
+	hostsMutex.Unlock()
+
+	disposeHosts(allHosts)
 }
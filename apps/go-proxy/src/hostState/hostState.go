@@ -1,6 +1,11 @@
 package hostState
 
-import "time"
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
 
 type State int
 
@@ -26,12 +31,268 @@ func (state State) String() string {
 	}
 }
 
-func WaitForState(state *State, target State, timeout time.Duration) bool {
-	i := 0
-	for *state != target && i < int(timeout.Seconds()) {
-		time.Sleep(1 * time.Second)
-		i++
+// ParseState returns the state matching the name returned by String
+func ParseState(name string) (State, bool) {
+	for _, state := range []State{Starting, Started, Stopping, Stopped} {
+		if state.String() == name {
+			return state, true
+		}
 	}
 
-	return *state == target
+	return Stopped, false
+}
+
+// transitions lists the states reachable from each state
+var transitions = map[State][]State{
+	Stopped:  {Starting, Started},
+	Starting: {Started, Stopped},
+	Started:  {Stopping, Stopped},
+	Stopping: {Stopped, Started},
+}
+
+func canTransition(from State, to State) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+type ReasonKind int
+
+const (
+	ReasonProxy      ReasonKind = 0
+	ReasonApi        ReasonKind = 1
+	ReasonInactivity ReasonKind = 2
+	ReasonPing       ReasonKind = 3
+	ReasonTimeout    ReasonKind = 4
+	ReasonFailure    ReasonKind = 5
+	ReasonStartup    ReasonKind = 6
+	ReasonSchedule   ReasonKind = 7
+	ReasonDependent  ReasonKind = 8
+)
+
+func (kind ReasonKind) String() string {
+	switch kind {
+	case ReasonProxy:
+		return "Proxy"
+	case ReasonApi:
+		return "Api"
+	case ReasonInactivity:
+		return "Inactivity"
+	case ReasonPing:
+		return "Ping"
+	case ReasonTimeout:
+		return "Timeout"
+	case ReasonFailure:
+		return "Failure"
+	case ReasonStartup:
+		return "Startup"
+	case ReasonSchedule:
+		return "Schedule"
+	case ReasonDependent:
+		return "Dependent"
+	default:
+		return "Unknown"
+	}
+}
+
+// Reason explains why a transition happened, Source holds the proxy name for proxy reasons
+// and the dependent host name for dependent reasons
+type Reason struct {
+	Kind   ReasonKind
+	Source string
+	// Client of the proxy for proxy reasons
+	ClientAddr string
+}
+
+func (reason Reason) String() string {
+	if reason.Source == "" {
+		return reason.Kind.String()
+	}
+
+	return fmt.Sprintf("%s %s", reason.Kind.String(), reason.Source)
+}
+
+func ProxyReason(proxyName string, clientAddr string) Reason {
+	return Reason{Kind: ReasonProxy, Source: proxyName, ClientAddr: clientAddr}
+}
+
+func ApiReason() Reason {
+	return Reason{Kind: ReasonApi}
+}
+
+func InactivityReason() Reason {
+	return Reason{Kind: ReasonInactivity}
+}
+
+func PingReason() Reason {
+	return Reason{Kind: ReasonPing}
+}
+
+func TimeoutReason() Reason {
+	return Reason{Kind: ReasonTimeout}
+}
+
+func ScheduleReason() Reason {
+	return Reason{Kind: ReasonSchedule}
+}
+
+// DependentReason is used when a host is woken because the host depending on it is starting
+func DependentReason(hostName string) Reason {
+	return Reason{Kind: ReasonDependent, Source: hostName}
+}
+
+func StartupReason() Reason {
+	return Reason{Kind: ReasonStartup}
+}
+
+func FailureReason(err error) Reason {
+	return Reason{Kind: ReasonFailure, Source: err.Error()}
+}
+
+type Event struct {
+	From   State
+	To     State
+	Reason Reason
+	Date   time.Time
+}
+
+// Machine owns the state of a host, it is safe for concurrent use
+type Machine struct {
+	state       State
+	changedAt   time.Time
+	changed     chan struct{}
+	subscribers map[int]chan Event
+	nextId      int
+
+	mutex sync.Mutex
+}
+
+func NewMachine(initialState State) *Machine {
+	return RestoreMachine(initialState, time.Now())
+}
+
+// RestoreMachine creates a machine in a state entered at changedAt, used to restore a persisted state
+func RestoreMachine(state State, changedAt time.Time) *Machine {
+	return &Machine{
+		state:       state,
+		changedAt:   changedAt,
+		changed:     make(chan struct{}),
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+func (machine *Machine) Get() State {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+
+	return machine.state
+}
+
+// ChangedAt returns the date of the last transition
+func (machine *Machine) ChangedAt() time.Time {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+
+	return machine.changedAt
+}
+
+func (machine *Machine) Is(states ...State) bool {
+	return slices.Contains(states, machine.Get())
+}
+
+func (machine *Machine) String() string {
+	return machine.Get().String()
+}
+
+// Transition moves the machine to the target state, it fails if the transition is not allowed from the current state
+func (machine *Machine) Transition(target State, reason Reason) error {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+
+	return machine.transition(target, reason)
+}
+
+// TransitionFrom moves the machine to the target state only if it is currently in the from state
+func (machine *Machine) TransitionFrom(from State, target State, reason Reason) error {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+
+	if machine.state != from {
+		return fmt.Errorf("state is %s, expected %s", machine.state.String(), from.String())
+	}
+
+	return machine.transition(target, reason)
+}
+
+// transition must be called with the mutex held
+func (machine *Machine) transition(target State, reason Reason) error {
+	if !canTransition(machine.state, target) {
+		return fmt.Errorf("invalid transition from %s to %s", machine.state.String(), target.String())
+	}
+
+	event := Event{
+		From:   machine.state,
+		To:     target,
+		Reason: reason,
+		Date:   time.Now(),
+	}
+
+	machine.state = target
+	machine.changedAt = event.Date
+
+	close(machine.changed)
+	machine.changed = make(chan struct{})
+
+	for _, subscriber := range machine.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// Slow subscribers miss events instead of blocking transitions
+		}
+	}
+
+	return nil
+}
+
+// WaitFor blocks until the machine reaches the target state or the timeout expires
+func (machine *Machine) WaitFor(target State, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		machine.mutex.Lock()
+		state := machine.state
+		changed := machine.changed
+		machine.mutex.Unlock()
+
+		if state == target {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return machine.Get() == target
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every transition and a function to unsubscribe
+func (machine *Machine) Subscribe() (<-chan Event, func()) {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+
+	id := machine.nextId
+	machine.nextId++
+
+	events := make(chan Event, 16)
+	machine.subscribers[id] = events
+
+	return events, func() {
+		machine.mutex.Lock()
+		defer machine.mutex.Unlock()
+
+		if _, exists := machine.subscribers[id]; exists {
+			delete(machine.subscribers, id)
+			close(events)
+		}
+	}
 }
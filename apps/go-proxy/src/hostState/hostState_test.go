@@ -0,0 +1,117 @@
+package hostState
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitionFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial State
+		from    State
+		target  State
+		fails   bool
+	}{
+		{name: "allowed", initial: Stopped, from: Stopped, target: Starting},
+		{name: "not in the from state", initial: Started, from: Stopped, target: Starting, fails: true},
+		{name: "illegal transition", initial: Stopped, from: Stopped, target: Stopping, fails: true},
+		{name: "same state", initial: Started, from: Started, target: Started, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			machine := RestoreMachine(test.initial, time.Time{})
+			err := machine.TransitionFrom(test.from, test.target, ApiReason())
+
+			if test.fails {
+				if err == nil {
+					t.Errorf("expected the transition to be rejected")
+				}
+
+				if !machine.Is(test.initial) || !machine.ChangedAt().IsZero() {
+					t.Errorf("expected the rejected transition to keep %s, got %s", test.initial, machine.String())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !machine.Is(test.target) || machine.ChangedAt().IsZero() {
+				t.Errorf("expected the machine to be %s, got %s", test.target, machine.String())
+			}
+		})
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	machine := NewMachine(Stopped)
+
+	start := time.Now()
+
+	if machine.WaitFor(Started, 50*time.Millisecond) {
+		t.Errorf("expected the wait to time out")
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the wait to last until the timeout, returned after %s", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		machine.Transition(Starting, ApiReason())
+		machine.Transition(Started, PingReason())
+	}()
+
+	if !machine.WaitFor(Started, time.Second) {
+		t.Errorf("expected the wait to return once started, got %s", machine.String())
+	}
+}
+
+func TestSlowSubscriberDoesNotBlock(t *testing.T) {
+	machine := NewMachine(Stopped)
+
+	// Never read
+	_, unsubscribeSlow := machine.Subscribe()
+	defer unsubscribeSlow()
+
+	events, unsubscribe := machine.Subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	transitions := 0
+
+	go func() {
+		defer close(done)
+
+		// More transitions than the buffer of the subscribers
+		for i := 0; i < 20; i++ {
+			machine.Transition(Starting, ApiReason())
+			machine.Transition(Stopped, ApiReason())
+			transitions += 2
+		}
+	}()
+
+	received := 0
+
+	for received < 16 {
+		select {
+		case <-events:
+			received++
+		case <-time.After(time.Second):
+			t.Fatalf("expected the events of the transitions, received %d", received)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the transitions not to be blocked by the slow subscriber")
+	}
+
+	if transitions != 40 || !machine.Is(Stopped) {
+		t.Errorf("expected 40 transitions ending stopped, got %d ending %s", transitions, machine.String())
+	}
+}
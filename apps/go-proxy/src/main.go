@@ -1,19 +1,33 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"mgarnier11.fr/go/libs/logger"
 
 	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/configValidator"
+	"mgarnier11.fr/go/go-proxy/ctl"
 	"mgarnier11.fr/go/go-proxy/hostManager"
 	"mgarnier11.fr/go/go-proxy/server"
+	"mgarnier11.fr/go/go-proxy/stateStore"
 
 	_ "net/http/pprof"
 )
 
+// Time given to the api requests, event streams included, to end on shutdown
+const serverShutdownTimeout = 5 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl.Run(os.Args[2:]))
+	}
+
 	logger.InitAppLogger("")
 
 	go func() {
@@ -33,9 +47,50 @@ func main() {
 
 	server := server.NewServer(config.Config.ServerPort)
 
-	go server.Start()
+	go func() {
+		if err := server.Start(); err != nil {
+			logger.Errorf("Server failed: %v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	configFiles := config.SetupConfigListener(configValidator.ValidateConfig)
+
+	for {
+		select {
+		case configFile := <-configFiles:
+			hostManager.ConfigFileChanged(configFile)
+		case receivedSignal := <-signals:
+			logger.Infof("Received %s, shutting down", receivedSignal)
+			shutdown(server, signals)
+			return
+		}
+	}
+}
+
+// shutdown drains the proxies, stops the server and persists the state, a second signal exits immediately
+func shutdown(server *server.Server, signals chan os.Signal) {
+	go func() {
+		receivedSignal := <-signals
+		logger.Errorf("Received %s again, exiting without draining", receivedSignal)
+		stateStore.Flush()
+		os.Exit(1)
+	}()
+
+	hostManager.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
 
-	for configFile := range config.SetupConfigListener() {
-		hostManager.ConfigFileChanged(configFile)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("Failed to stop server: %v", err)
 	}
+
+	if err := stateStore.Flush(); err != nil {
+		logger.Errorf("Failed to persist state: %v", err)
+	}
+
+	logger.Infof("Shutdown complete")
 }
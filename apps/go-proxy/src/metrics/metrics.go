@@ -0,0 +1,252 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/hostState"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "goproxy"
+
+var allStates = []hostState.State{hostState.Starting, hostState.Started, hostState.Stopping, hostState.Stopped}
+
+var (
+	hostStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_state",
+		Help:      "1 for the current state of the host, 0 for the others",
+	}, []string{"host", "state"})
+
+	wakesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_wakes_total",
+		Help:      "Number of times the host was woken up, by reason",
+	}, []string{"host", "reason"})
+
+	sleepsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_sleeps_total",
+		Help:      "Number of times the host was put to sleep, by reason",
+	}, []string{"host", "reason"})
+
+	wakeLatencyHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "host_wake_duration_seconds",
+		Help:      "Time between the wake request and the host being started",
+		Buckets:   []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120},
+	}, []string{"host"})
+
+	activeConnectionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "proxy_active_connections",
+		Help:      "Number of connections (or udp sessions) currently open on the proxy",
+	}, []string{"host", "proxy"})
+
+	acceptedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_accepted_connections_total",
+		Help:      "Number of connections (or udp sessions) accepted by the proxy",
+	}, []string{"host", "proxy"})
+
+	deniedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_denied_connections_total",
+		Help:      "Number of connections (or udp datagrams) refused by the access list of the proxy",
+	}, []string{"host", "proxy"})
+
+	rejectedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_rejected_connections_total",
+		Help:      "Number of connections (or udp sessions) rejected by the limits of the proxy, by reason",
+	}, []string{"host", "proxy", "reason"})
+
+	bytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_bytes_total",
+		Help:      "Bytes transferred by the proxy, by direction",
+	}, []string{"host", "proxy", "direction"})
+
+	stateDurations = &stateDurationCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "host_state_seconds_total"),
+			"Time spent by the host in each state",
+			[]string{"host", "state"},
+			nil,
+		),
+		hosts: make(map[string]*stateDurationTracker),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(stateDurations)
+}
+
+// WatchHost records the state metrics of the host until the context is cancelled, it subscribes before returning so that
+// no transition is missed
+func WatchHost(ctx context.Context, hostName string, machine *hostState.Machine) {
+	events, unsubscribe := machine.Subscribe()
+
+	setHostState(hostName, machine.Get())
+	stateDurations.track(hostName, machine.Get(), machine.ChangedAt())
+
+	go recordTransitions(ctx, hostName, events, unsubscribe)
+}
+
+func recordTransitions(ctx context.Context, hostName string, events <-chan hostState.Event, unsubscribe func()) {
+	defer unsubscribe()
+
+	var wakeStart time.Time
+
+	for {
+		select {
+		case event := <-events:
+			setHostState(hostName, event.To)
+			stateDurations.transition(hostName, event)
+
+			switch event.To {
+			case hostState.Starting:
+				wakesCounter.WithLabelValues(hostName, event.Reason.Kind.String()).Inc()
+				wakeStart = event.Date
+			case hostState.Stopping:
+				sleepsCounter.WithLabelValues(hostName, event.Reason.Kind.String()).Inc()
+			case hostState.Started:
+				if event.From == hostState.Starting && !wakeStart.IsZero() {
+					wakeLatencyHistogram.WithLabelValues(hostName).Observe(event.Date.Sub(wakeStart).Seconds())
+				}
+			}
+
+		case <-ctx.Done():
+			forgetHost(hostName)
+			return
+		}
+	}
+}
+
+func setHostState(hostName string, current hostState.State) {
+	for _, state := range allStates {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+
+		hostStateGauge.WithLabelValues(hostName, state.String()).Set(value)
+	}
+}
+
+func forgetHost(hostName string) {
+	hostStateGauge.DeletePartialMatch(prometheus.Labels{"host": hostName})
+	wakesCounter.DeletePartialMatch(prometheus.Labels{"host": hostName})
+	sleepsCounter.DeletePartialMatch(prometheus.Labels{"host": hostName})
+	wakeLatencyHistogram.DeleteLabelValues(hostName)
+	stateDurations.forget(hostName)
+}
+
+// ConnectionOpened is called when a proxy accepts a connection or creates an udp session
+func ConnectionOpened(hostName string, proxyKey string) {
+	acceptedConnectionsCounter.WithLabelValues(hostName, proxyKey).Inc()
+	activeConnectionsGauge.WithLabelValues(hostName, proxyKey).Inc()
+}
+
+func ConnectionClosed(hostName string, proxyKey string) {
+	activeConnectionsGauge.WithLabelValues(hostName, proxyKey).Dec()
+}
+
+// ConnectionDenied is called when a proxy refuses a client because of its access list
+func ConnectionDenied(hostName string, proxyKey string) {
+	deniedConnectionsCounter.WithLabelValues(hostName, proxyKey).Inc()
+}
+
+// ConnectionRejected is called when a proxy refuses a client because of its limits
+func ConnectionRejected(hostName string, proxyKey string, reason string) {
+	rejectedConnectionsCounter.WithLabelValues(hostName, proxyKey, reason).Inc()
+}
+
+func ClientToServerBytes(hostName string, proxyKey string, bytes int) {
+	bytesCounter.WithLabelValues(hostName, proxyKey, "client_to_server").Add(float64(bytes))
+}
+
+func ServerToClientBytes(hostName string, proxyKey string, bytes int) {
+	bytesCounter.WithLabelValues(hostName, proxyKey, "server_to_client").Add(float64(bytes))
+}
+
+// ForgetProxy removes the metrics of a disposed proxy
+func ForgetProxy(hostName string, proxyKey string) {
+	labels := prometheus.Labels{"host": hostName, "proxy": proxyKey}
+
+	activeConnectionsGauge.DeletePartialMatch(labels)
+	acceptedConnectionsCounter.DeletePartialMatch(labels)
+	deniedConnectionsCounter.DeletePartialMatch(labels)
+	rejectedConnectionsCounter.DeletePartialMatch(labels)
+	bytesCounter.DeletePartialMatch(labels)
+}
+
+type stateDurationTracker struct {
+	durations map[hostState.State]time.Duration
+	state     hostState.State
+	since     time.Time
+}
+
+// stateDurationCollector exposes the time spent in each state, including the time spent in the current state
+type stateDurationCollector struct {
+	desc  *prometheus.Desc
+	hosts map[string]*stateDurationTracker
+	mutex sync.Mutex
+}
+
+func (collector *stateDurationCollector) track(hostName string, state hostState.State, since time.Time) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.hosts[hostName] = &stateDurationTracker{
+		durations: make(map[hostState.State]time.Duration),
+		state:     state,
+		since:     since,
+	}
+}
+
+func (collector *stateDurationCollector) transition(hostName string, event hostState.Event) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	tracker := collector.hosts[hostName]
+	if tracker == nil {
+		return
+	}
+
+	tracker.durations[tracker.state] += event.Date.Sub(tracker.since)
+	tracker.state = event.To
+	tracker.since = event.Date
+}
+
+func (collector *stateDurationCollector) forget(hostName string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	delete(collector.hosts, hostName)
+}
+
+func (collector *stateDurationCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.desc
+}
+
+func (collector *stateDurationCollector) Collect(metrics chan<- prometheus.Metric) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	for hostName, tracker := range collector.hosts {
+		for _, state := range allStates {
+			duration := tracker.durations[state]
+
+			if state == tracker.state {
+				duration += time.Since(tracker.since)
+			}
+
+			metrics <- prometheus.MustNewConstMetric(collector.desc, prometheus.CounterValue, duration.Seconds(), hostName, state.String())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+// waitFor polls the condition, the transitions are recorded in the background
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+
+	return condition()
+}
+
+func TestWatchHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	machine := hostState.NewMachine(hostState.Stopped)
+	WatchHost(ctx, "test-watch", machine)
+
+	// Right after WatchHost returns, the transitions are not missed
+	machine.Transition(hostState.Starting, hostState.ApiReason())
+	machine.Transition(hostState.Started, hostState.PingReason())
+	machine.Transition(hostState.Stopping, hostState.InactivityReason())
+
+	recorded := waitFor(func() bool {
+		return testutil.ToFloat64(wakesCounter.WithLabelValues("test-watch", "Api")) == 1 &&
+			testutil.ToFloat64(sleepsCounter.WithLabelValues("test-watch", "Inactivity")) == 1 &&
+			testutil.CollectAndCount(wakeLatencyHistogram) == 1
+	})
+
+	if !recorded {
+		t.Fatalf("expected the wake, the sleep and the wake duration to be recorded")
+	}
+
+	cancel()
+
+	forgotten := waitFor(func() bool {
+		return testutil.CollectAndCount(hostStateGauge) == 0 && testutil.CollectAndCount(wakesCounter) == 0 &&
+			testutil.CollectAndCount(sleepsCounter) == 0 && testutil.CollectAndCount(wakeLatencyHistogram) == 0
+	})
+
+	if !forgotten {
+		t.Errorf("expected the series of the host to be deleted")
+	}
+}
@@ -0,0 +1,305 @@
+package passive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const (
+	minecraftStatusState  = 1
+	minecraftTimeout      = 5 * time.Second
+	minecraftMaxPacketLen = 1 << 16
+	defaultMinecraftMotd  = "Server is sleeping, join it to wake it up"
+)
+
+type minecraftHandshake struct {
+	protocolVersion int32
+	serverAddress   string
+	serverPort      uint16
+	nextState       int32
+	// Bytes sent by the client after the handshake packet
+	rest []byte
+}
+
+// minecraftResponder answers the server list pings, with the status of the server when it is started
+// and with the last known status or an offline status when it is not
+type minecraftResponder struct {
+	serverAddr string
+	motd       string
+	state      *hostState.Machine
+
+	cachedStatus []byte
+	mutex        sync.Mutex
+}
+
+func newMinecraftResponder(serverAddr string, motd string, state *hostState.Machine) *minecraftResponder {
+	if motd == "" {
+		motd = defaultMinecraftMotd
+	}
+
+	return &minecraftResponder{
+		serverAddr: serverAddr,
+		motd:       motd,
+		state:      state,
+	}
+}
+
+func (responder *minecraftResponder) Match(peekBuffer []byte, hostStarted bool) bool {
+	handshake, err := parseMinecraftHandshake(peekBuffer)
+
+	return err == nil && handshake.nextState == minecraftStatusState
+}
+
+func (responder *minecraftResponder) Respond(clientConn net.Conn, peekBuffer []byte) error {
+	handshake, err := parseMinecraftHandshake(peekBuffer)
+
+	if err != nil {
+		return err
+	}
+
+	clientConn.SetDeadline(time.Now().Add(minecraftTimeout))
+
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(handshake.rest), clientConn))
+
+	// Status request
+	packetId, _, err := readMinecraftPacket(reader)
+
+	if err != nil {
+		return fmt.Errorf("failed to read status request: %v", err)
+	}
+
+	if packetId != 0x00 {
+		return fmt.Errorf("unexpected packet %d instead of status request", packetId)
+	}
+
+	status := responder.getStatus(handshake)
+
+	if _, err := clientConn.Write(newMinecraftPacket(0x00, appendMinecraftString(nil, string(status)))); err != nil {
+		return fmt.Errorf("failed to write status response: %v", err)
+	}
+
+	// Ping request, answered with the same payload
+	packetId, payload, err := readMinecraftPacket(reader)
+
+	if err != nil || packetId != 0x01 {
+		// Some clients close the connection right after the status
+		return nil
+	}
+
+	_, err = clientConn.Write(newMinecraftPacket(0x01, payload))
+
+	return err
+}
+
+func (responder *minecraftResponder) String() string {
+	return ResponderMinecraft
+}
+
+func (responder *minecraftResponder) getStatus(handshake *minecraftHandshake) []byte {
+	if responder.state.Is(hostState.Started) {
+		status, err := queryMinecraftStatus(responder.serverAddr, handshake)
+
+		if err == nil {
+			responder.mutex.Lock()
+			responder.cachedStatus = status
+			responder.mutex.Unlock()
+
+			return status
+		}
+	}
+
+	responder.mutex.Lock()
+	cachedStatus := responder.cachedStatus
+	responder.mutex.Unlock()
+
+	return responder.offlineStatus(cachedStatus, handshake)
+}
+
+// offlineStatus returns the cached status with no players online and the configured motd, or a minimal status if nothing is cached
+func (responder *minecraftResponder) offlineStatus(cachedStatus []byte, handshake *minecraftHandshake) []byte {
+	status := map[string]any{}
+
+	if cachedStatus == nil || json.Unmarshal(cachedStatus, &status) != nil {
+		status = map[string]any{
+			"version": map[string]any{"name": "Sleeping", "protocol": handshake.protocolVersion},
+		}
+	}
+
+	status["description"] = map[string]any{"text": responder.motd}
+
+	players, _ := status["players"].(map[string]any)
+	if players == nil {
+		players = map[string]any{"max": 0}
+	}
+
+	players["online"] = 0
+	delete(players, "sample")
+	status["players"] = players
+
+	bytes, err := json.Marshal(status)
+
+	if err != nil {
+		return []byte(`{"description":{"text":"Sleeping"}}`)
+	}
+
+	return bytes
+}
+
+// queryMinecraftStatus asks the server for its status, forwarding the handshake of the client
+func queryMinecraftStatus(serverAddr string, handshake *minecraftHandshake) ([]byte, error) {
+	serverConn, err := net.DialTimeout("tcp", serverAddr, minecraftTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+	defer serverConn.Close()
+
+	serverConn.SetDeadline(time.Now().Add(minecraftTimeout))
+
+	handshakeData := binary.AppendUvarint(nil, uint64(uint32(handshake.protocolVersion)))
+	handshakeData = appendMinecraftString(handshakeData, handshake.serverAddress)
+	handshakeData = binary.BigEndian.AppendUint16(handshakeData, handshake.serverPort)
+	handshakeData = binary.AppendUvarint(handshakeData, minecraftStatusState)
+
+	request := append(newMinecraftPacket(0x00, handshakeData), newMinecraftPacket(0x00, nil)...)
+
+	if _, err := serverConn.Write(request); err != nil {
+		return nil, err
+	}
+
+	packetId, payload, err := readMinecraftPacket(bufio.NewReader(serverConn))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if packetId != 0x00 {
+		return nil, fmt.Errorf("unexpected packet %d instead of status response", packetId)
+	}
+
+	status, err := readMinecraftString(bytes.NewReader(payload))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(status), nil
+}
+
+func parseMinecraftHandshake(peekBuffer []byte) (*minecraftHandshake, error) {
+	reader := bytes.NewReader(peekBuffer)
+
+	packetId, payload, err := readMinecraftPacket(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if packetId != 0x00 {
+		return nil, errors.New("not a handshake packet")
+	}
+
+	payloadReader := bytes.NewReader(payload)
+	handshake := &minecraftHandshake{}
+
+	protocolVersion, err := binary.ReadUvarint(payloadReader)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake.protocolVersion = int32(protocolVersion)
+
+	if handshake.serverAddress, err = readMinecraftString(payloadReader); err != nil {
+		return nil, err
+	}
+
+	if err = binary.Read(payloadReader, binary.BigEndian, &handshake.serverPort); err != nil {
+		return nil, err
+	}
+
+	nextState, err := binary.ReadUvarint(payloadReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if payloadReader.Len() != 0 {
+		return nil, errors.New("unexpected data in handshake")
+	}
+
+	handshake.nextState = int32(nextState)
+	handshake.rest = peekBuffer[len(peekBuffer)-reader.Len():]
+
+	return handshake, nil
+}
+
+// readMinecraftPacket reads a length prefixed packet and returns its id and payload
+func readMinecraftPacket(reader io.ByteReader) (int32, []byte, error) {
+	length, err := binary.ReadUvarint(reader)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if length == 0 || length > minecraftMaxPacketLen {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	data := make([]byte, length)
+	for i := range data {
+		if data[i], err = reader.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	dataReader := bytes.NewReader(data)
+
+	packetId, err := binary.ReadUvarint(dataReader)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int32(packetId), data[len(data)-dataReader.Len():], nil
+}
+
+func readMinecraftString(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+
+	if err != nil {
+		return "", err
+	}
+
+	if length > uint64(reader.Len()) {
+		return "", errors.New("string longer than packet")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func appendMinecraftString(data []byte, value string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+
+	return append(data, value...)
+}
+
+func newMinecraftPacket(packetId int32, payload []byte) []byte {
+	data := binary.AppendUvarint(nil, uint64(packetId))
+	data = append(data, payload...)
+
+	return append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+}
@@ -0,0 +1,117 @@
+package passive
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"mgarnier11.fr/go/libs/utils"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const ResponderMinecraft = "minecraft"
+
+// Responder answers a client by itself, without forwarding the connection nor waking the host
+type Responder interface {
+	// Match reports whether the responder handles the connection, given the first bytes sent by the client
+	Match(peekBuffer []byte, hostStarted bool) bool
+	Respond(clientConn net.Conn, peekBuffer []byte) error
+	String() string
+}
+
+// Passive holds the responders and ignore rules of a proxy
+type Passive struct {
+	responders     []Responder
+	ignoreNetworks []*net.IPNet
+	ignorePatterns []*regexp.Regexp
+}
+
+func NewPassive(passiveConfig *config.PassiveConfig, serverAddr string, state *hostState.Machine) (*Passive, error) {
+	passive := &Passive{
+		responders: []Responder{&statusHeaderResponder{}},
+	}
+
+	if passiveConfig == nil {
+		return passive, nil
+	}
+
+	for _, name := range passiveConfig.Responders {
+		switch strings.ToLower(name) {
+		case ResponderMinecraft:
+			passive.responders = append(passive.responders, newMinecraftResponder(serverAddr, passiveConfig.Motd, state))
+		default:
+			return nil, fmt.Errorf("unknown responder %s", name)
+		}
+	}
+
+	for _, cidr := range passiveConfig.IgnoreCidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignored cidr %s: %v", cidr, err)
+		}
+
+		passive.ignoreNetworks = append(passive.ignoreNetworks, network)
+	}
+
+	for _, pattern := range passiveConfig.IgnorePatterns {
+		regex, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignored pattern %s: %v", pattern, err)
+		}
+
+		passive.ignorePatterns = append(passive.ignorePatterns, regex)
+	}
+
+	return passive, nil
+}
+
+// FindResponder returns the first responder handling the connection, or nil
+func (passive *Passive) FindResponder(peekBuffer []byte, hostStarted bool) Responder {
+	for _, responder := range passive.responders {
+		if responder.Match(peekBuffer, hostStarted) {
+			return responder
+		}
+	}
+
+	return nil
+}
+
+// IsIgnored reports whether the connection must neither wake the host nor count as activity
+func (passive *Passive) IsIgnored(remoteAddr net.Addr, peekBuffer []byte) bool {
+	if ip := acl.GetIp(remoteAddr); ip != nil {
+		for _, network := range passive.ignoreNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, pattern := range passive.ignorePatterns {
+		if pattern.Match(peekBuffer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusHeaderResponder drops the HTTP requests carrying the "Status: true" header while the host is not started
+type statusHeaderResponder struct{}
+
+func (responder *statusHeaderResponder) Match(peekBuffer []byte, hostStarted bool) bool {
+	return !hostStarted && utils.IsHTTPRequest(peekBuffer) && utils.CheckRequestHeader(string(peekBuffer), "Status", "true")
+}
+
+func (responder *statusHeaderResponder) Respond(clientConn net.Conn, peekBuffer []byte) error {
+	return nil
+}
+
+func (responder *statusHeaderResponder) String() string {
+	return "status header"
+}
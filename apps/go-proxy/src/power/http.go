@@ -0,0 +1,49 @@
+package power
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// sendWebhook sends the request and fails if the response status is not 2xx
+func sendWebhook(url string, method string, headers map[string]string, body string) (string, error) {
+	if url == "" {
+		return "", fmt.Errorf("webhook url is not configured")
+	}
+
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), url, bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("webhook %s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	output := strings.TrimSpace(string(respBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return output, fmt.Errorf("webhook %s %s returned %s", method, url, resp.Status)
+	}
+
+	return output, nil
+}
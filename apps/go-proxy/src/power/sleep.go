@@ -0,0 +1,202 @@
+package power
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/libs/dockerssh"
+
+	"mgarnier11.fr/go/go-proxy/config"
+
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SleepTypeSuspend   = "suspend"
+	SleepTypeHibernate = "hibernate"
+	SleepTypePoweroff  = "poweroff"
+	SleepTypeSSH       = "ssh"
+	SleepTypeHttp      = "http"
+
+	PreSleepHookCommand    = "command"
+	PreSleepHookContainers = "containers"
+
+	// The host usually drops the ssh session while going to sleep, if the command did not
+	// return after this delay it is considered as running
+	sleepCommandTimeout = 10 * time.Second
+)
+
+var sleepCommands = map[string]string{
+	SleepTypeSuspend:   "sudo pm-suspend",
+	SleepTypeHibernate: "sudo systemctl hibernate",
+	SleepTypePoweroff:  "sudo systemctl poweroff",
+}
+
+type SleepResult struct {
+	Strategy string    `yaml:"strategy"`
+	Output   string    `yaml:"output"`
+	Error    string    `yaml:"error,omitempty"`
+	Date     time.Time `yaml:"date"`
+}
+
+func (result *SleepResult) Success() bool {
+	return result.Error == ""
+}
+
+type SleepStrategy interface {
+	// Sleep sends the sleep request and returns the output of the command or webhook
+	Sleep() (string, error)
+	String() string
+}
+
+// NewSleepStrategy returns the sleep strategy configured for the host, defaults to suspend
+func NewSleepStrategy(hostConfig *config.HostConfig) (SleepStrategy, error) {
+	sleepConfig := hostConfig.Sleep
+
+	if sleepConfig == nil {
+		sleepConfig = &config.SleepConfig{}
+	}
+
+	sleepType := strings.ToLower(sleepConfig.Type)
+
+	switch sleepType {
+	case SleepTypeSuspend, SleepTypeHibernate, SleepTypePoweroff, "":
+		if sleepType == "" {
+			sleepType = SleepTypeSuspend
+		}
+
+		return &sshSleepStrategy{
+			name:    sleepType,
+			target:  hostSSHTarget(hostConfig),
+			command: sleepCommands[sleepType],
+		}, nil
+
+	case SleepTypeSSH:
+		if sleepConfig.Command == "" {
+			return nil, errors.New("ssh sleep strategy requires a command")
+		}
+
+		return &sshSleepStrategy{
+			name:    sleepType,
+			target:  hostSSHTarget(hostConfig),
+			command: expandCommand(sleepConfig.Command, hostConfig),
+		}, nil
+
+	case SleepTypeHttp:
+		return &httpSleepStrategy{
+			url:     sleepConfig.Url,
+			method:  sleepConfig.Method,
+			headers: sleepConfig.Headers,
+			body:    expandCommand(sleepConfig.Body, hostConfig),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown sleep strategy %s", sleepConfig.Type)
+	}
+}
+
+type sshSleepStrategy struct {
+	name    string
+	target  *config.SSHTargetConfig
+	command string
+}
+
+func (strategy *sshSleepStrategy) Sleep() (string, error) {
+	output, err := runSSHCommand(strategy.target, strategy.command, sleepCommandTimeout)
+
+	var exitMissingError *ssh.ExitMissingError
+
+	if errors.Is(err, errSSHCommandTimeout) || errors.As(err, &exitMissingError) {
+		// The session was cut or is still running because the host is going to sleep
+		return output, nil
+	}
+
+	return output, err
+}
+
+func (strategy *sshSleepStrategy) String() string {
+	return fmt.Sprintf("%s (%s)", strategy.name, strategy.command)
+}
+
+type httpSleepStrategy struct {
+	url     string
+	method  string
+	headers map[string]string
+	body    string
+}
+
+func (strategy *httpSleepStrategy) Sleep() (string, error) {
+	return sendWebhook(strategy.url, strategy.method, strategy.headers, strategy.body)
+}
+
+func (strategy *httpSleepStrategy) String() string {
+	return fmt.Sprintf("http %s", strategy.url)
+}
+
+// RunPreSleepHooks returns an error if one of the hooks of the host refuses the sleep
+func RunPreSleepHooks(hostConfig *config.HostConfig) error {
+	if hostConfig.Sleep == nil {
+		return nil
+	}
+
+	for _, hook := range hostConfig.Sleep.PreSleepHooks {
+		var err error
+
+		switch strings.ToLower(hook.Type) {
+		case PreSleepHookCommand:
+			err = runCommandHook(hostConfig, hook)
+		case PreSleepHookContainers:
+			err = runContainersHook(hostConfig, hook)
+		default:
+			err = fmt.Errorf("unknown pre sleep hook %s", hook.Type)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runCommandHook(hostConfig *config.HostConfig, hook *config.PreSleepHookConfig) error {
+	output, err := runSSHCommand(hostSSHTarget(hostConfig), expandCommand(hook.Command, hostConfig), sshCommandTimeout)
+
+	if err != nil {
+		return fmt.Errorf("pre sleep command refused sleep: %v, output: %s", err, output)
+	}
+
+	return nil
+}
+
+func runContainersHook(hostConfig *config.HostConfig, hook *config.PreSleepHookConfig) error {
+	dockerClient, err := dockerssh.GetDockerClient(hostConfig.SSHUsername, hostConfig.Ip, hostConfig.SSHPort, config.Config.SSHPrivateKey)
+
+	if err != nil {
+		return fmt.Errorf("failed to get docker client: %v", err)
+	}
+	defer dockerClient.Close()
+
+	containers, err := dockerClient.ContainerList(context.Background(), container.ListOptions{})
+
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	for _, container := range containers {
+		for _, name := range container.Names {
+			containerName := strings.TrimPrefix(name, "/")
+
+			if slices.Contains(hook.Containers, containerName) {
+				return fmt.Errorf("container %s is running", containerName)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package power
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/libs/sshutils"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+const sshCommandTimeout = 30 * time.Second
+
+var errSSHCommandTimeout = errors.New("ssh command timed out")
+
+// runSSHCommand runs the command on the target and returns its combined output
+func runSSHCommand(target *config.SSHTargetConfig, command string, timeout time.Duration) (string, error) {
+	sshClient, err := sshutils.GetSSHClient(target.SSHUsername, target.Ip, target.SSHPort, config.Config.SSHPrivateKey)
+
+	if err != nil {
+		return "", err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	type commandResult struct {
+		output []byte
+		err    error
+	}
+
+	resultChan := make(chan commandResult, 1)
+
+	go func() {
+		output, err := session.CombinedOutput(command)
+		resultChan <- commandResult{output: output, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		output := strings.TrimSpace(string(result.output))
+
+		if result.err != nil {
+			return output, fmt.Errorf("command %q failed: %w", command, result.err)
+		}
+
+		return output, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("command %q: %w after %v", command, errSSHCommandTimeout, timeout)
+	}
+}
+
+// RunHostCommand runs the command on the host over ssh and returns its combined output
+func RunHostCommand(hostConfig *config.HostConfig, command string, timeout time.Duration) (string, error) {
+	return runSSHCommand(hostSSHTarget(hostConfig), expandCommand(command, hostConfig), timeout)
+}
+
+func hostSSHTarget(hostConfig *config.HostConfig) *config.SSHTargetConfig {
+	return &config.SSHTargetConfig{
+		Ip:          hostConfig.Ip,
+		SSHUsername: hostConfig.SSHUsername,
+		SSHPort:     hostConfig.SSHPort,
+	}
+}
+
+// expandCommand replaces the {name}, {ip} and {mac} placeholders with the values of the host
+func expandCommand(command string, hostConfig *config.HostConfig) string {
+	return strings.NewReplacer(
+		"{name}", hostConfig.Name,
+		"{ip}", hostConfig.Ip,
+		"{mac}", hostConfig.MacAddress,
+	).Replace(command)
+}
@@ -0,0 +1,197 @@
+package power
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+const (
+	WakeTypeWol   = "wol"
+	WakeTypeRelay = "relay"
+	WakeTypeHttp  = "http"
+	WakeTypeSSH   = "ssh"
+
+	defaultBroadcastAddress = "255.255.255.255"
+	defaultWolPort          = 9
+	defaultRelayCommand     = "wakeonlan -i {broadcast} -p {port} {mac}"
+)
+
+type WakeStrategy interface {
+	// Wake sends the wake request, it does not wait for the host to be started
+	Wake() error
+	String() string
+}
+
+// NewWakeStrategy returns the wake strategy configured for the host, defaults to broadcast Wake-on-LAN
+func NewWakeStrategy(hostConfig *config.HostConfig) (WakeStrategy, error) {
+	wakeConfig := hostConfig.Wake
+
+	if wakeConfig == nil {
+		wakeConfig = &config.WakeConfig{}
+	}
+
+	broadcastAddress := wakeConfig.BroadcastAddress
+	if broadcastAddress == "" {
+		broadcastAddress = defaultBroadcastAddress
+	}
+
+	port := wakeConfig.Port
+	if port == 0 {
+		port = defaultWolPort
+	}
+
+	switch strings.ToLower(wakeConfig.Type) {
+	case WakeTypeWol, "":
+		return &wolStrategy{
+			macAddress: hostConfig.MacAddress,
+			address:    net.JoinHostPort(broadcastAddress, strconv.Itoa(port)),
+		}, nil
+
+	case WakeTypeRelay:
+		if wakeConfig.SSH == nil {
+			return nil, errors.New("relay wake strategy requires an ssh target")
+		}
+
+		command := wakeConfig.Command
+		if command == "" {
+			command = defaultRelayCommand
+		}
+
+		command = strings.NewReplacer("{broadcast}", broadcastAddress, "{port}", strconv.Itoa(port)).Replace(command)
+
+		return &sshWakeStrategy{
+			target:  wakeConfig.SSH,
+			command: expandCommand(command, hostConfig),
+			relay:   true,
+		}, nil
+
+	case WakeTypeHttp:
+		return &httpWakeStrategy{
+			url:     wakeConfig.Url,
+			method:  wakeConfig.Method,
+			headers: wakeConfig.Headers,
+			body:    expandCommand(wakeConfig.Body, hostConfig),
+		}, nil
+
+	case WakeTypeSSH:
+		if wakeConfig.SSH == nil {
+			return nil, errors.New("ssh wake strategy requires an ssh target")
+		}
+
+		if wakeConfig.Command == "" {
+			return nil, errors.New("ssh wake strategy requires a command")
+		}
+
+		return &sshWakeStrategy{
+			target:  wakeConfig.SSH,
+			command: expandCommand(wakeConfig.Command, hostConfig),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown wake strategy %s", wakeConfig.Type)
+	}
+}
+
+type wolStrategy struct {
+	macAddress string
+	address    string
+}
+
+func (strategy *wolStrategy) Wake() error {
+	packet, err := newMagicPacket(strategy.macAddress)
+
+	if err != nil {
+		return fmt.Errorf("failed to create magic packet: %v", err)
+	}
+
+	err = sendUDPPacket(packet, strategy.address)
+
+	if err != nil {
+		return fmt.Errorf("failed to send magic packet to %s: %v", strategy.address, err)
+	}
+
+	return nil
+}
+
+func (strategy *wolStrategy) String() string {
+	return fmt.Sprintf("wol %s", strategy.address)
+}
+
+type sshWakeStrategy struct {
+	target  *config.SSHTargetConfig
+	command string
+	relay   bool
+}
+
+func (strategy *sshWakeStrategy) Wake() error {
+	_, err := runSSHCommand(strategy.target, strategy.command, sshCommandTimeout)
+
+	return err
+}
+
+func (strategy *sshWakeStrategy) String() string {
+	if strategy.relay {
+		return fmt.Sprintf("relay %s", strategy.target.Ip)
+	}
+
+	return fmt.Sprintf("ssh %s", strategy.target.Ip)
+}
+
+type httpWakeStrategy struct {
+	url     string
+	method  string
+	headers map[string]string
+	body    string
+}
+
+func (strategy *httpWakeStrategy) Wake() error {
+	_, err := sendWebhook(strategy.url, strategy.method, strategy.headers, strategy.body)
+
+	return err
+}
+
+func (strategy *httpWakeStrategy) String() string {
+	return fmt.Sprintf("http %s", strategy.url)
+}
+
+// MagicPacket is a slice of 102 bytes containing the magic packet data.
+type MagicPacket [102]byte
+
+// NewMagicPacket allocates a new MagicPacket with the specified MAC.
+func newMagicPacket(macAddr string) (packet MagicPacket, err error) {
+	mac, err := net.ParseMAC(macAddr)
+	if err != nil {
+		return packet, err
+	}
+
+	if len(mac) != 6 {
+		return packet, errors.New("invalid EUI-48 MAC address")
+	}
+
+	// write magic bytes to packet
+	copy(packet[0:], []byte{255, 255, 255, 255, 255, 255})
+	offset := 6
+
+	for i := 0; i < 16; i++ {
+		copy(packet[offset:], mac)
+		offset += 6
+	}
+
+	return packet, nil
+}
+
+func sendUDPPacket(mp MagicPacket, addr string) (err error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(mp[:])
+	return err
+}
@@ -0,0 +1,173 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/power"
+)
+
+const (
+	TypeTcp     = "tcp"
+	TypeHttp    = "http"
+	TypeCommand = "command"
+
+	probeTimeout  = 2 * time.Second
+	probeInterval = 500 * time.Millisecond
+)
+
+type Probe interface {
+	// Check returns nil if the probed service is ready
+	Check() error
+	String() string
+}
+
+// NewProbe creates the probe described by the config, defaultPort is used by tcp probes without port
+func NewProbe(probeConfig *config.ProbeConfig, hostConfig *config.HostConfig, defaultPort int) (Probe, error) {
+	switch strings.ToLower(probeConfig.Type) {
+	case TypeTcp:
+		port := probeConfig.Port
+		if port == 0 {
+			port = defaultPort
+		}
+
+		if port == 0 {
+			return nil, errors.New("tcp probe requires a port")
+		}
+
+		return &tcpProbe{address: net.JoinHostPort(hostConfig.Ip, strconv.Itoa(port))}, nil
+
+	case TypeHttp:
+		if probeConfig.Url == "" {
+			return nil, errors.New("http probe requires an url")
+		}
+
+		status := probeConfig.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		return &httpProbe{url: probeConfig.Url, status: status}, nil
+
+	case TypeCommand:
+		if probeConfig.Command == "" {
+			return nil, errors.New("command probe requires a command")
+		}
+
+		return &commandProbe{hostConfig: hostConfig, command: probeConfig.Command}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown probe type %s", probeConfig.Type)
+	}
+}
+
+// NewTcpProbe creates a probe checking that the address accepts tcp connections
+func NewTcpProbe(address string) Probe {
+	return &tcpProbe{address: address}
+}
+
+// CheckHost runs all the readiness probes of the host and returns the first failure
+func CheckHost(hostConfig *config.HostConfig) error {
+	for _, probeConfig := range hostConfig.ReadinessProbes {
+		probe, err := NewProbe(probeConfig, hostConfig, 0)
+
+		if err != nil {
+			return err
+		}
+
+		if err := probe.Check(); err != nil {
+			return fmt.Errorf("%s: %v", probe.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// WaitReady checks the probe until it succeeds, the deadline expires or the context is cancelled
+func WaitReady(ctx context.Context, probe Probe, deadline time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		err := probe.Check()
+
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %v: %v", probe.String(), deadline, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+type tcpProbe struct {
+	address string
+}
+
+func (probe *tcpProbe) Check() error {
+	conn, err := net.DialTimeout("tcp", probe.address, probeTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (probe *tcpProbe) String() string {
+	return fmt.Sprintf("tcp %s", probe.address)
+}
+
+type httpProbe struct {
+	url    string
+	status int
+}
+
+func (probe *httpProbe) Check() error {
+	client := &http.Client{Timeout: probeTimeout}
+
+	resp, err := client.Get(probe.url)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != probe.status {
+		return fmt.Errorf("expected status %d, got %d", probe.status, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (probe *httpProbe) String() string {
+	return fmt.Sprintf("http %s", probe.url)
+}
+
+type commandProbe struct {
+	hostConfig *config.HostConfig
+	command    string
+}
+
+func (probe *commandProbe) Check() error {
+	_, err := power.RunHostCommand(probe.hostConfig, probe.command, probeTimeout*5)
+
+	return err
+}
+
+func (probe *commandProbe) String() string {
+	return fmt.Sprintf("command %s", probe.command)
+}
@@ -0,0 +1,162 @@
+package proxies
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+const openConnectionsActivityInterval = 30 * time.Second
+
+// activityTracker applies the activity rules of a proxy before reporting the traffic to the host
+type activityTracker struct {
+	proxyName         string
+	ignore            bool
+	minBytesPerMinute int
+	openConnections   bool
+	excludedNetworks  []*net.IPNet
+	packetReceived    func(proxyName string, clientAddr string)
+
+	windowStart time.Time
+	windowBytes int
+	// Number of open connections by client address
+	openClients map[string]int
+	mutex       sync.Mutex
+}
+
+func newActivityTracker(ctx context.Context, proxyName string, activityConfig *config.ActivityConfig, packetReceived func(proxyName string, clientAddr string)) (*activityTracker, error) {
+	tracker := &activityTracker{
+		proxyName:      proxyName,
+		packetReceived: packetReceived,
+		openClients:    make(map[string]int),
+	}
+
+	if activityConfig == nil {
+		return tracker, nil
+	}
+
+	tracker.ignore = activityConfig.Ignore
+	tracker.minBytesPerMinute = activityConfig.MinBytesPerMinute
+	tracker.openConnections = activityConfig.OpenConnections
+
+	for _, cidr := range activityConfig.ExcludeCidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded cidr %s: %v", cidr, err)
+		}
+
+		tracker.excludedNetworks = append(tracker.excludedNetworks, network)
+	}
+
+	if tracker.openConnections && !tracker.ignore {
+		go tracker.reportOpenConnections(ctx)
+	}
+
+	return tracker, nil
+}
+
+// counts reports whether the traffic of the client can count as activity
+func (tracker *activityTracker) counts(clientAddr net.Addr) bool {
+	if tracker.ignore {
+		return false
+	}
+
+	ip := acl.GetIp(clientAddr)
+
+	for _, network := range tracker.excludedNetworks {
+		if ip != nil && network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wakeRequested is called when the client wakes the host, it always counts so that the host is not stopped right after waking up
+func (tracker *activityTracker) wakeRequested(clientAddr net.Addr) {
+	tracker.packetReceived(tracker.proxyName, clientAddr.String())
+}
+
+// bytesReceived is called for the bytes sent by the client to the server
+func (tracker *activityTracker) bytesReceived(clientAddr net.Addr, bytes int) {
+	if !tracker.counts(clientAddr) {
+		return
+	}
+
+	if tracker.minBytesPerMinute > 0 {
+		tracker.mutex.Lock()
+
+		if time.Since(tracker.windowStart) > time.Minute {
+			tracker.windowStart = time.Now()
+			tracker.windowBytes = 0
+		}
+
+		tracker.windowBytes += bytes
+		reached := tracker.windowBytes >= tracker.minBytesPerMinute
+
+		tracker.mutex.Unlock()
+
+		if !reached {
+			return
+		}
+	}
+
+	tracker.packetReceived(tracker.proxyName, clientAddr.String())
+}
+
+func (tracker *activityTracker) connectionOpened(clientAddr net.Addr) {
+	if !tracker.openConnections || !tracker.counts(clientAddr) {
+		return
+	}
+
+	tracker.mutex.Lock()
+	tracker.openClients[clientAddr.String()]++
+	tracker.mutex.Unlock()
+
+	tracker.packetReceived(tracker.proxyName, clientAddr.String())
+}
+
+func (tracker *activityTracker) connectionClosed(clientAddr net.Addr) {
+	if !tracker.openConnections || !tracker.counts(clientAddr) {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.openClients[clientAddr.String()]--
+
+	if tracker.openClients[clientAddr.String()] <= 0 {
+		delete(tracker.openClients, clientAddr.String())
+	}
+}
+
+// reportOpenConnections reports the open connections as activity until the proxy is stopped
+func (tracker *activityTracker) reportOpenConnections(ctx context.Context) {
+	ticker := time.NewTicker(openConnectionsActivityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tracker.mutex.Lock()
+			clientAddrs := make([]string, 0, len(tracker.openClients))
+			for clientAddr := range tracker.openClients {
+				clientAddrs = append(clientAddrs, clientAddr)
+			}
+			tracker.mutex.Unlock()
+
+			for _, clientAddr := range clientAddrs {
+				tracker.packetReceived(tracker.proxyName, clientAddr)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxies
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/hostState"
+)
+
+const holdingPageRetryAfter = 3
+
+var holdingPageTemplate = template.Must(template.New("holdingPage").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta http-equiv="refresh" content="{{.RetryAfter}}">
+	<title>{{.HostName}} is waking up</title>
+	<style>
+		body { font-family: sans-serif; background: #1e1e2e; color: #cdd6f4; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+		main { text-align: center; width: 320px; }
+		.bar { background: #313244; border-radius: 4px; height: 8px; overflow: hidden; }
+		.progress { background: #89b4fa; height: 100%; width: {{.Progress}}%; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{.HostName}} is waking up</h1>
+		<p>{{.Message}}</p>
+		<div class="bar"><div class="progress"></div></div>
+		<p><small>This page refreshes automatically</small></p>
+	</main>
+</body>
+</html>
+`))
+
+type holdingPageData struct {
+	HostName   string `json:"host"`
+	State      string `json:"state"`
+	Message    string `json:"message"`
+	Progress   int    `json:"progress"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+func newHoldingPageData(hostName string, state *hostState.Machine, startTimeout time.Duration, message string) *holdingPageData {
+	progress := 100
+
+	if !state.Is(hostState.Started) {
+		// The progress never reaches 100% before the host is started
+		progress = min(int(time.Since(state.ChangedAt())*100/startTimeout), 95)
+	}
+
+	return &holdingPageData{
+		HostName:   hostName,
+		State:      state.String(),
+		Message:    message,
+		Progress:   progress,
+		RetryAfter: holdingPageRetryAfter,
+	}
+}
+
+// writeHoldingPage answers the request with a 503, as JSON if the client accepts it or as an HTML page otherwise
+func writeHoldingPage(writer io.Writer, request string, data *holdingPageData) error {
+	body := &bytes.Buffer{}
+	contentType := "text/html; charset=utf-8"
+
+	if strings.Contains(getRequestHeader(request, "Accept"), "application/json") {
+		contentType = "application/json"
+
+		if err := json.NewEncoder(body).Encode(data); err != nil {
+			return err
+		}
+	} else if err := holdingPageTemplate.Execute(body, data); err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nRetry-After: %d\r\nCache-Control: no-store\r\nConnection: close\r\n\r\n",
+		http.StatusServiceUnavailable,
+		http.StatusText(http.StatusServiceUnavailable),
+		contentType,
+		body.Len(),
+		data.RetryAfter,
+	)
+
+	if _, err := io.WriteString(writer, header); err != nil {
+		return err
+	}
+
+	_, err := body.WriteTo(writer)
+
+	return err
+}
+
+// getRequestHeader returns the value of the header in the raw request, or an empty string if it is missing
+func getRequestHeader(request string, name string) string {
+	for _, line := range strings.Split(request, "\r\n")[1:] {
+		if line == "" {
+			break
+		}
+
+		key, value, found := strings.Cut(line, ":")
+
+		if found && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,175 @@
+package proxies
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/config"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons of the connections rejected by the limits, used as metric labels
+const (
+	rejectMaxConnections       = "max_connections"
+	rejectMaxClientConnections = "max_client_connections"
+	rejectRate                 = "rate"
+)
+
+// connectionLimiter caps the connections (or udp sessions) of a proxy, in total, by client ip and by second
+type connectionLimiter struct {
+	maxConnections       int
+	maxClientConnections int
+	rate                 *rate.Limiter
+
+	connections int
+	// Number of open connections by client ip
+	clientConnections map[string]int
+	mutex             sync.Mutex
+}
+
+func newConnectionLimiter(limitsConfig *config.LimitsConfig) *connectionLimiter {
+	limiter := &connectionLimiter{
+		clientConnections: make(map[string]int),
+	}
+
+	if limitsConfig == nil {
+		return limiter
+	}
+
+	limiter.maxConnections = limitsConfig.MaxConnections
+	limiter.maxClientConnections = limitsConfig.MaxConnectionsPerClient
+
+	if limitsConfig.ConnectionsPerSecond > 0 {
+		burst := int(math.Max(1, math.Ceil(limitsConfig.ConnectionsPerSecond)))
+		limiter.rate = rate.NewLimiter(rate.Limit(limitsConfig.ConnectionsPerSecond), burst)
+	}
+
+	return limiter
+}
+
+// acquire counts a new connection of the client, it returns the reason of the rejection or an empty string when it is accepted
+func (limiter *connectionLimiter) acquire(clientAddr net.Addr) string {
+	clientIp := getClientIp(clientAddr)
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.maxConnections > 0 && limiter.connections >= limiter.maxConnections {
+		return rejectMaxConnections
+	}
+
+	if limiter.maxClientConnections > 0 && limiter.clientConnections[clientIp] >= limiter.maxClientConnections {
+		return rejectMaxClientConnections
+	}
+
+	if limiter.rate != nil && !limiter.rate.Allow() {
+		return rejectRate
+	}
+
+	limiter.connections++
+	limiter.clientConnections[clientIp]++
+
+	return ""
+}
+
+// count returns the number of open connections
+func (limiter *connectionLimiter) count() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.connections
+}
+
+// release forgets a connection accepted by acquire
+func (limiter *connectionLimiter) release(clientAddr net.Addr) {
+	clientIp := getClientIp(clientAddr)
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.connections--
+	limiter.clientConnections[clientIp]--
+
+	if limiter.clientConnections[clientIp] <= 0 {
+		delete(limiter.clientConnections, clientIp)
+	}
+}
+
+// getClientIp returns the ip the client is counted by, the whole address when it has no ip
+func getClientIp(clientAddr net.Addr) string {
+	if ip := acl.GetIp(clientAddr); ip != nil {
+		return ip.String()
+	}
+
+	return clientAddr.String()
+}
+
+// newBandwidthLimiter returns a limiter of bytesPerSecond shared by the connections of a proxy, or nil when it is not limited
+func newBandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// waitBandwidth waits until the limiter allows the bytes to be sent, a nil limiter never waits
+func waitBandwidth(ctx context.Context, limiter *rate.Limiter, bytes int) error {
+	if limiter == nil {
+		return nil
+	}
+
+	for bytes > 0 {
+		chunk := min(bytes, limiter.Burst())
+
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+
+		bytes -= chunk
+	}
+
+	return nil
+}
+
+// shapedWriter delays the writes to stay under the bandwidth of the limiter
+type shapedWriter struct {
+	io.Writer
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// newShapedWriter returns the writer limited by the limiter, or the writer itself when the limiter is nil
+func newShapedWriter(ctx context.Context, writer io.Writer, limiter *rate.Limiter) io.Writer {
+	if limiter == nil {
+		return writer
+	}
+
+	return &shapedWriter{Writer: writer, ctx: ctx, limiter: limiter}
+}
+
+func (writer *shapedWriter) Write(data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		chunk := data[written:min(len(data), written+writer.limiter.Burst())]
+
+		if err := writer.limiter.WaitN(writer.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		bytesWritten, err := writer.Writer.Write(chunk)
+		written += bytesWritten
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
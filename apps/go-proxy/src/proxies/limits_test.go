@@ -0,0 +1,92 @@
+package proxies
+
+import (
+	"net"
+	"testing"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+func newClientAddr(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestConnectionLimiterClientConnections(t *testing.T) {
+	limiter := newConnectionLimiter(&config.LimitsConfig{MaxConnections: 3, MaxConnectionsPerClient: 2})
+
+	first := newClientAddr("192.0.2.1", 1000)
+	second := newClientAddr("192.0.2.1", 1001)
+
+	for _, clientAddr := range []net.Addr{first, second} {
+		if reason := limiter.acquire(clientAddr); reason != "" {
+			t.Fatalf("expected the connection of %s to be accepted, got %s", clientAddr, reason)
+		}
+	}
+
+	// Counted by ip, whatever the port
+	if reason := limiter.acquire(newClientAddr("192.0.2.1", 1002)); reason != rejectMaxClientConnections {
+		t.Errorf("expected %s, got %q", rejectMaxClientConnections, reason)
+	}
+
+	if reason := limiter.acquire(newClientAddr("192.0.2.2", 1000)); reason != "" {
+		t.Errorf("expected the connection of another client to be accepted, got %s", reason)
+	}
+
+	if reason := limiter.acquire(newClientAddr("192.0.2.3", 1000)); reason != rejectMaxConnections {
+		t.Errorf("expected %s, got %q", rejectMaxConnections, reason)
+	}
+
+	limiter.release(first)
+
+	if reason := limiter.acquire(newClientAddr("192.0.2.1", 1003)); reason != "" {
+		t.Errorf("expected a released connection to free a slot, got %s", reason)
+	}
+
+	if count := limiter.count(); count != 3 {
+		t.Errorf("expected 3 open connections, got %d", count)
+	}
+}
+
+func TestConnectionLimiterRate(t *testing.T) {
+	limiter := newConnectionLimiter(&config.LimitsConfig{ConnectionsPerSecond: 2})
+	clientAddr := newClientAddr("192.0.2.1", 1000)
+
+	// The burst allows the connections of one second at once
+	for i := 0; i < 2; i++ {
+		if reason := limiter.acquire(clientAddr); reason != "" {
+			t.Fatalf("expected connection %d to be accepted, got %s", i, reason)
+		}
+	}
+
+	if reason := limiter.acquire(clientAddr); reason != rejectRate {
+		t.Errorf("expected %s, got %q", rejectRate, reason)
+	}
+
+	if count := limiter.count(); count != 2 {
+		t.Errorf("expected the rejected connection not to be counted, got %d", count)
+	}
+}
+
+func TestConnectionLimiterUnlimited(t *testing.T) {
+	limiter := newConnectionLimiter(nil)
+
+	for i := 0; i < 100; i++ {
+		if reason := limiter.acquire(newClientAddr("192.0.2.1", 1000+i)); reason != "" {
+			t.Fatalf("expected no limit, got %s", reason)
+		}
+	}
+}
+
+func TestGetClientIp(t *testing.T) {
+	if clientIp := getClientIp(newClientAddr("2001:db8::1", 1000)); clientIp != "2001:db8::1" {
+		t.Errorf("expected the ip of the client, got %s", clientIp)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if clientIp := getClientIp(server.RemoteAddr()); clientIp != "pipe" {
+		t.Errorf("expected the whole address without an ip, got %s", clientIp)
+	}
+}
@@ -0,0 +1,208 @@
+package proxies
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/hostDriver"
+	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/probe"
+)
+
+type Proxy interface {
+	Start(hostWaitGroup *sync.WaitGroup)
+	// Stop stops accepting clients, waits up to drainTimeout for the open connections to end then closes them
+	Stop(drainTimeout time.Duration)
+	GetConfig() *config.ProxyConfig
+	// SetAccessList replaces the access list, it applies to the next connections
+	SetAccessList(accessList *acl.List)
+	// ListenerReleased is closed once the proxy no longer holds its listen port, which can be before the end of Stop
+	ListenerReleased() <-chan struct{}
+}
+
+const defaultReadinessTimeout = 60 * time.Second
+
+// Time allowed to a client to send its proxy protocol header
+const proxyProtocolTimeout = 5 * time.Second
+
+const drainPollInterval = 100 * time.Millisecond
+
+type ProxyArgs struct {
+	HostConfig     *config.HostConfig
+	ProxyConfig    *config.ProxyConfig
+	HostState      *hostState.Machine
+	StartHost      func(reason hostState.Reason) error
+	PacketReceived func(proxyName string, clientAddr string)
+	AccessList     *acl.List
+	// Driver of the host, the proxies forward to its server ip
+	Driver hostDriver.HostDriver
+}
+
+// accessFilter holds the access list of a proxy, it can be replaced while the proxy runs
+type accessFilter struct {
+	accessList atomic.Pointer[acl.List]
+}
+
+func (filter *accessFilter) SetAccessList(accessList *acl.List) {
+	filter.accessList.Store(accessList)
+}
+
+func (filter *accessFilter) allows(clientAddr net.Addr) bool {
+	return filter.accessList.Load().Allows(clientAddr)
+}
+
+// listenerRelease signals the release of the listen port of a proxy, so that a new proxy can take it while the old one drains
+type listenerRelease struct {
+	released chan struct{}
+	init     sync.Once
+	close    sync.Once
+}
+
+func (release *listenerRelease) ListenerReleased() <-chan struct{} {
+	release.init.Do(func() {
+		release.released = make(chan struct{})
+	})
+
+	return release.released
+}
+
+func (release *listenerRelease) releaseListener() {
+	release.ListenerReleased()
+	release.close.Do(func() {
+		close(release.released)
+	})
+}
+
+// newTrustedProxies returns the list of the peers allowed to send the proxy protocol header, an invalid list trusts no peer
+func newTrustedProxies(trustedProxies []string, proxyLogger *logger.Logger) *acl.List {
+	if len(trustedProxies) == 0 {
+		return nil
+	}
+
+	list, err := acl.NewList(&config.AccessConfig{Allow: trustedProxies})
+
+	if err != nil {
+		proxyLogger.Errorf("Invalid trusted proxies, no proxy protocol header will be accepted: %v", err)
+		return nil
+	}
+
+	return list
+}
+
+// isTrustedProxy reports whether the peer may send a proxy protocol header, no peer is trusted by a nil list
+func isTrustedProxy(trustedProxies *acl.List, peerAddr net.Addr) bool {
+	return trustedProxies != nil && trustedProxies.Allows(peerAddr)
+}
+
+// NewProxy creates the proxy matching the protocol of the proxy config
+func NewProxy(args *ProxyArgs, hostLogger *logger.Logger) (Proxy, error) {
+	switch args.ProxyConfig.Protocol {
+	case config.ProtocolTCP, "":
+		tcpProxy, err := NewTCPProxy(args, hostLogger)
+		if err != nil {
+			return nil, err
+		}
+
+		return tcpProxy, nil
+	case config.ProtocolUDP:
+		udpProxy, err := NewUDPProxy(args, hostLogger)
+		if err != nil {
+			return nil, err
+		}
+
+		return udpProxy, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", args.ProxyConfig.Protocol)
+	}
+}
+
+// wakeHost starts the host if it is stopped and waits for it to be started, it reports whether the host was not started yet
+func wakeHost(reason hostState.Reason, state *hostState.Machine, startHost func(reason hostState.Reason) error, onWake func(), startTimeout time.Duration) (bool, error) {
+	if state.Is(hostState.Started) {
+		return false, nil
+	}
+
+	if state.Is(hostState.Stopped, hostState.Stopping) {
+		onWake()
+		err := startHost(reason)
+
+		if err != nil {
+			return true, fmt.Errorf("failed to start host: %v", err)
+		}
+	}
+
+	hostStarted := state.WaitFor(hostState.Started, startTimeout)
+
+	if !hostStarted {
+		return true, fmt.Errorf("host took too long to start")
+	}
+
+	return true, nil
+}
+
+// newProxyActivityTracker returns the activity tracker of the proxy, an invalid activity config is logged and ignored
+func newProxyActivityTracker(ctx context.Context, args *ProxyArgs, proxyLogger *logger.Logger) *activityTracker {
+	tracker, err := newActivityTracker(ctx, args.ProxyConfig.Name, args.ProxyConfig.Activity, args.PacketReceived)
+
+	if err != nil {
+		proxyLogger.Errorf("Invalid activity config, ignoring it: %v", err)
+		tracker, _ = newActivityTracker(ctx, args.ProxyConfig.Name, nil, args.PacketReceived)
+	}
+
+	return tracker
+}
+
+// drainConnections waits until the proxy has no open connection, it reports false when the timeout expired first
+func drainConnections(limiter *connectionLimiter, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for limiter.count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	return true
+}
+
+// getLimits returns the limits of the proxy, an empty config when it has none
+func getLimits(proxyConfig *config.ProxyConfig) *config.LimitsConfig {
+	if proxyConfig.Limits == nil {
+		return &config.LimitsConfig{}
+	}
+
+	return proxyConfig.Limits
+}
+
+// isServerStarting reports whether the server may not be ready yet, because the host was just woken or started less than
+// readinessTimeout ago. The readiness probe is skipped otherwise, so that it does not run for every connection
+func isServerStarting(woken bool, state *hostState.Machine, readinessTimeout time.Duration) bool {
+	return woken || time.Since(state.ChangedAt()) < readinessTimeout
+}
+
+// newReadinessProbe returns the probe configured on the proxy, or nil if there is none
+func newReadinessProbe(args *ProxyArgs) (probe.Probe, error) {
+	if args.ProxyConfig.ReadinessProbe == nil {
+		return nil, nil
+	}
+
+	return args.Driver.NewReadinessProbe(args.ProxyConfig.ReadinessProbe, args.ProxyConfig.ServerPort)
+}
+
+func getReadinessTimeout(proxyConfig *config.ProxyConfig) time.Duration {
+	if proxyConfig.ReadinessTimeout <= 0 {
+		return defaultReadinessTimeout
+	}
+
+	return time.Duration(proxyConfig.ReadinessTimeout) * time.Second
+}
@@ -0,0 +1,166 @@
+package proxies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	tlsRecordHeaderSize   = 5
+	tlsRecordHandshake    = 0x16
+	tlsClientHello        = 0x01
+	tlsServerNameExt      = 0x0000
+	tlsServerNameHostName = 0x00
+	// Largest tls record, the client hello is expected to fit in the first one
+	maxTLSRecordSize = tlsRecordHeaderSize + 16384
+)
+
+// errIncomplete is returned while more data is needed to find the name
+var errIncomplete = errors.New("incomplete data")
+
+// parseRoutingName returns the lowercase name requested by the client, from the tls server name or the http host header
+func parseRoutingName(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errIncomplete
+	}
+
+	var name string
+	var err error
+
+	if data[0] == tlsRecordHandshake {
+		name, err = parseServerName(data)
+	} else {
+		name, err = parseHttpHost(data)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.ToLower(name), "."), nil
+}
+
+// parseServerName returns the server name of the tls client hello
+func parseServerName(data []byte) (string, error) {
+	if len(data) < tlsRecordHeaderSize {
+		return "", errIncomplete
+	}
+
+	recordLength := int(binary.BigEndian.Uint16(data[3:5]))
+
+	if tlsRecordHeaderSize+recordLength > maxTLSRecordSize {
+		return "", errors.New("tls record too large")
+	}
+
+	if len(data) < tlsRecordHeaderSize+recordLength {
+		return "", errIncomplete
+	}
+
+	reader := &byteReader{data: data[tlsRecordHeaderSize : tlsRecordHeaderSize+recordLength]}
+
+	if reader.readUint8() != tlsClientHello {
+		return "", errors.New("not a tls client hello")
+	}
+
+	reader.skip(3)  // Handshake length
+	reader.skip(2)  // Client version
+	reader.skip(32) // Random
+	reader.skip(int(reader.readUint8()))
+	reader.skip(int(reader.readUint16()))
+	reader.skip(int(reader.readUint8()))
+
+	extensions := &byteReader{data: reader.read(int(reader.readUint16()))}
+
+	for extensions.remaining() > 0 && !extensions.failed {
+		extensionType := extensions.readUint16()
+		extension := &byteReader{data: extensions.read(int(extensions.readUint16()))}
+
+		if extensionType != tlsServerNameExt {
+			continue
+		}
+
+		names := &byteReader{data: extension.read(int(extension.readUint16()))}
+
+		for names.remaining() > 0 && !names.failed {
+			nameType := names.readUint8()
+			name := names.read(int(names.readUint16()))
+
+			if nameType == tlsServerNameHostName && !names.failed {
+				return string(name), nil
+			}
+		}
+	}
+
+	if reader.failed || extensions.failed {
+		return "", errors.New("malformed tls client hello")
+	}
+
+	return "", errors.New("no server name in the tls client hello")
+}
+
+// parseHttpHost returns the host header of the http request, without its port
+func parseHttpHost(data []byte) (string, error) {
+	headersEnd := bytes.Index(data, []byte("\r\n\r\n"))
+
+	if headersEnd < 0 {
+		return "", errIncomplete
+	}
+
+	host := getRequestHeader(string(data[:headersEnd+2]), "Host")
+
+	if host == "" {
+		return "", errors.New("no host header in the http request")
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return host, nil
+}
+
+// byteReader reads big endian values, reading past the end marks it as failed and returns zero values
+type byteReader struct {
+	data   []byte
+	failed bool
+}
+
+func (reader *byteReader) remaining() int {
+	return len(reader.data)
+}
+
+func (reader *byteReader) read(length int) []byte {
+	if length > len(reader.data) {
+		reader.failed = true
+		reader.data = nil
+		return nil
+	}
+
+	value := reader.data[:length]
+	reader.data = reader.data[length:]
+
+	return value
+}
+
+func (reader *byteReader) skip(length int) {
+	reader.read(length)
+}
+
+func (reader *byteReader) readUint8() uint8 {
+	if value := reader.read(1); value != nil {
+		return value[0]
+	}
+
+	return 0
+}
+
+func (reader *byteReader) readUint16() uint16 {
+	if value := reader.read(2); value != nil {
+		return binary.BigEndian.Uint16(value)
+	}
+
+	return 0
+}
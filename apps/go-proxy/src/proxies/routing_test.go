@@ -0,0 +1,146 @@
+package proxies
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// newClientHello returns a tls record holding a client hello, with the server name extension when serverName is set
+func newClientHello(serverName string) []byte {
+	extensions := []byte{}
+
+	if serverName != "" {
+		names := []byte{tlsServerNameHostName}
+		names = binary.BigEndian.AppendUint16(names, uint16(len(serverName)))
+		names = append(names, serverName...)
+
+		extension := binary.BigEndian.AppendUint16(nil, uint16(len(names)))
+		extension = append(extension, names...)
+
+		extensions = binary.BigEndian.AppendUint16(extensions, tlsServerNameExt)
+		extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(extension)))
+		extensions = append(extensions, extension...)
+	}
+
+	// Unrelated extension placed after the server name, to check that the others are skipped
+	extensions = append(extensions, 0x00, 0x0b, 0x00, 0x02, 0x01, 0x00)
+
+	body := []byte{0x03, 0x03}                  // Client version
+	body = append(body, make([]byte, 32)...)    // Random
+	body = append(body, 0x00)                   // Session id
+	body = append(body, 0x00, 0x02, 0x13, 0x01) // Cipher suites
+	body = append(body, 0x01, 0x00)             // Compression methods
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := []byte{tlsClientHello, 0x00}
+	handshake = binary.BigEndian.AppendUint16(handshake, uint16(len(body)))
+	handshake = append(handshake, body...)
+
+	record := []byte{tlsRecordHandshake, 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(handshake)))
+
+	return append(record, handshake...)
+}
+
+// withRecordLength returns a copy of the record with the length of its header replaced
+func withRecordLength(record []byte, length int) []byte {
+	record = append([]byte{}, record...)
+	binary.BigEndian.PutUint16(record[3:5], uint16(length))
+
+	return record
+}
+
+func TestParseServerName(t *testing.T) {
+	clientHello := newClientHello("App.Example.com")
+
+	// Client hello whose extensions length runs past the end of the record
+	malformed := append([]byte{}, clientHello...)
+	extensionsLengthOffset := len(malformed) - len("App.Example.com") - 9 - 6 - 2
+	binary.BigEndian.PutUint16(malformed[extensionsLengthOffset:], 0xffff)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		expected   string
+		incomplete bool
+		fails      bool
+	}{
+		{name: "server name", data: clientHello, expected: "App.Example.com"},
+		{name: "truncated record header", data: clientHello[:3], incomplete: true},
+		{name: "truncated record", data: clientHello[:len(clientHello)-10], incomplete: true},
+		{name: "oversized record", data: withRecordLength(clientHello, maxTLSRecordSize), fails: true},
+		{name: "malformed extensions", data: malformed, fails: true},
+		{name: "record shorter than the client hello", data: withRecordLength(clientHello, 20), fails: true},
+		{name: "not a client hello", data: []byte{tlsRecordHandshake, 0x03, 0x01, 0x00, 0x01, 0x02}, fails: true},
+		{name: "missing server name", data: newClientHello(""), fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := parseServerName(test.data)
+
+			switch {
+			case test.incomplete:
+				if !errors.Is(err, errIncomplete) {
+					t.Errorf("expected incomplete data, got %q, %v", name, err)
+				}
+			case test.fails:
+				if err == nil || errors.Is(err, errIncomplete) {
+					t.Errorf("expected an error, got %q, %v", name, err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case name != test.expected:
+				t.Errorf("expected %q, got %q", test.expected, name)
+			}
+		})
+	}
+}
+
+func TestParseHttpHost(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		expected   string
+		incomplete bool
+		fails      bool
+	}{
+		{name: "host", data: "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n", expected: "app.example.com"},
+		{name: "host with port", data: "GET / HTTP/1.1\r\nHost: app.example.com:8080\r\n\r\n", expected: "app.example.com"},
+		{name: "header name case", data: "GET / HTTP/1.1\r\nhost: app.example.com\r\n\r\n", expected: "app.example.com"},
+		{name: "ipv6 host with port", data: "GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n", expected: "::1"},
+		{name: "headers not ended", data: "GET / HTTP/1.1\r\nHost: app.example.com\r\n", incomplete: true},
+		{name: "missing host", data: "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, err := parseHttpHost([]byte(test.data))
+
+			switch {
+			case test.incomplete:
+				if !errors.Is(err, errIncomplete) {
+					t.Errorf("expected incomplete data, got %q, %v", host, err)
+				}
+			case test.fails:
+				if err == nil || errors.Is(err, errIncomplete) {
+					t.Errorf("expected an error, got %q, %v", host, err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case host != test.expected:
+				t.Errorf("expected %q, got %q", test.expected, host)
+			}
+		})
+	}
+}
+
+func TestParseRoutingName(t *testing.T) {
+	name, err := parseRoutingName(newClientHello("App.Example.com."))
+
+	if err != nil || name != "app.example.com" {
+		t.Errorf("expected the lowercase server name without the trailing dot, got %q, %v", name, err)
+	}
+}
@@ -0,0 +1,252 @@
+package proxies
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/colors"
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/acl"
+	"mgarnier11.fr/go/go-proxy/proxyProtocol"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Time allowed to a client of a shared listener to send the name it requests
+const routingTimeout = 5 * time.Second
+
+// sharedListener accepts the connections of a listen port shared by the proxies having hostnames, and hands each one
+// to the proxy owning the tls server name or http host requested by the client
+type sharedListener struct {
+	port                int
+	acceptProxyProtocol bool
+	trustedProxies      *acl.List
+	// Entries of trustedProxies, the proxies of the port must trust the same peers
+	trustedProxyEntries []string
+	listener            *net.TCPListener
+	logger              *logger.Logger
+
+	// Proxies by lowercase hostname, wildcards are stored as *.domain
+	proxies map[string]*TCPProxy
+	mutex   sync.Mutex
+}
+
+var sharedListeners = make(map[int]*sharedListener)
+
+// Protects sharedListeners, taken before the mutex of a listener
+var sharedListenersMutex sync.Mutex
+
+// registerSharedProxy routes the hostnames of the proxy to it, the listener of the port is started by its first proxy
+func registerSharedProxy(proxy *TCPProxy) error {
+	sharedListenersMutex.Lock()
+	defer sharedListenersMutex.Unlock()
+
+	shared, exists := sharedListeners[proxy.ListenAddr.Port]
+
+	if !exists {
+		listener, err := net.ListenTCP("tcp", proxy.ListenAddr)
+		if err != nil {
+			return err
+		}
+
+		shared = &sharedListener{
+			port:                proxy.ListenAddr.Port,
+			acceptProxyProtocol: proxy.acceptProxyProtocol,
+			trustedProxies:      proxy.trustedProxies,
+			trustedProxyEntries: proxy.config.TrustedProxies,
+			listener:            listener,
+			logger:              logger.NewLogger(fmt.Sprintf("[SHARED:%d]", proxy.ListenAddr.Port), "%-15s ", lipgloss.NewStyle().Foreground(lipgloss.Color(colors.GenerateHexColor(listener.Addr().String()))), nil),
+			proxies:             make(map[string]*TCPProxy),
+		}
+
+		sharedListeners[shared.port] = shared
+
+		go shared.run()
+	}
+
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.acceptProxyProtocol != proxy.acceptProxyProtocol {
+		return errors.New("acceptProxyProtocol differs from the other proxies of the port")
+	}
+
+	if !slices.Equal(shared.trustedProxyEntries, proxy.config.TrustedProxies) {
+		return errors.New("trustedProxies differs from the other proxies of the port")
+	}
+
+	for _, hostname := range proxy.hostnames {
+		if owner, exists := shared.proxies[hostname]; exists && owner != proxy {
+			return fmt.Errorf("hostname %s already routed to %s", hostname, owner.key)
+		}
+	}
+
+	for _, hostname := range proxy.hostnames {
+		shared.proxies[hostname] = proxy
+	}
+
+	shared.logger.Infof("Routing %s to %s", strings.Join(proxy.hostnames, ", "), proxy.key)
+
+	return nil
+}
+
+// unregisterSharedProxy stops routing connections to the proxy, the listener is closed with its last proxy
+func unregisterSharedProxy(proxy *TCPProxy) {
+	sharedListenersMutex.Lock()
+	defer sharedListenersMutex.Unlock()
+
+	shared, exists := sharedListeners[proxy.ListenAddr.Port]
+
+	if !exists {
+		return
+	}
+
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	for hostname, owner := range shared.proxies {
+		if owner == proxy {
+			delete(shared.proxies, hostname)
+		}
+	}
+
+	if len(shared.proxies) == 0 {
+		shared.logger.Infof("No proxy left, closing the listener")
+		delete(sharedListeners, shared.port)
+		shared.listener.Close()
+	}
+}
+
+func (shared *sharedListener) run() {
+	shared.logger.Infof("Shared listener started on %s", shared.listener.Addr())
+
+	for {
+		clientConn, err := shared.listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				shared.logger.Infof("Shared listener stopped")
+				return
+			}
+
+			shared.logger.Errorf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		go shared.handleConnection(clientConn)
+	}
+}
+
+func (shared *sharedListener) handleConnection(tcpConn *net.TCPConn) {
+	defer tcpConn.Close()
+
+	var clientConn net.Conn = tcpConn
+
+	if shared.acceptProxyProtocol {
+		if !isTrustedProxy(shared.trustedProxies, tcpConn.RemoteAddr()) {
+			shared.logger.Debugf("Proxy protocol header not accepted from untrusted peer %s", tcpConn.RemoteAddr())
+			return
+		}
+
+		proxyConn, err := proxyProtocol.ReadHeader(tcpConn, proxyProtocolTimeout)
+
+		if err != nil {
+			shared.logger.Errorf("Invalid proxy protocol header from %s: %v", tcpConn.RemoteAddr(), err)
+			return
+		}
+
+		clientConn = proxyConn
+	}
+
+	peekBuffer, hostname, err := readRoutingName(clientConn)
+
+	if err != nil {
+		shared.logger.Debugf("Failed to find the name requested by %s: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+
+	proxy := shared.route(hostname)
+
+	if proxy == nil {
+		shared.logger.Debugf("No proxy for %s requested by %s", hostname, clientConn.RemoteAddr())
+		return
+	}
+
+	defer proxy.wg.Done()
+
+	shared.logger.Debugf("Routing %s from %s to %s", hostname, clientConn.RemoteAddr(), proxy.key)
+
+	proxy.handleClient(clientConn, peekBuffer)
+}
+
+// route returns the proxy owning the hostname, or nil. The proxy wait group is incremented before the proxy can be unregistered,
+// so the caller must call Done once the connection is handled
+func (shared *sharedListener) route(hostname string) *TCPProxy {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	proxy, exists := shared.proxies[hostname]
+
+	if !exists {
+		if _, domain, found := strings.Cut(hostname, "."); found {
+			proxy, exists = shared.proxies["*."+domain]
+		}
+	}
+
+	if !exists {
+		return nil
+	}
+
+	proxy.wg.Add(1)
+
+	return proxy
+}
+
+// normalizeHostnames lowercases the hostnames and removes their trailing dot
+func normalizeHostnames(hostnames []string) []string {
+	normalized := []string{}
+
+	for _, hostname := range hostnames {
+		normalized = append(normalized, strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), "."))
+	}
+
+	return normalized
+}
+
+// readRoutingName reads the client data until the requested name is found, it returns the data read and the name
+func readRoutingName(clientConn net.Conn) ([]byte, string, error) {
+	if err := clientConn.SetReadDeadline(time.Now().Add(routingTimeout)); err != nil {
+		return nil, "", err
+	}
+
+	peekBuffer := make([]byte, 0, 1024)
+	readBuffer := make([]byte, 1024)
+
+	for {
+		bytesRead, err := clientConn.Read(readBuffer)
+		peekBuffer = append(peekBuffer, readBuffer[:bytesRead]...)
+
+		hostname, parseErr := parseRoutingName(peekBuffer)
+
+		if parseErr == nil {
+			return peekBuffer, hostname, clientConn.SetReadDeadline(time.Time{})
+		}
+
+		if !errors.Is(parseErr, errIncomplete) {
+			return nil, "", parseErr
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(peekBuffer) >= maxTLSRecordSize {
+			return nil, "", errors.New("name not found in the first bytes")
+		}
+	}
+}
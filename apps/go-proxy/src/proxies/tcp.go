@@ -13,68 +13,121 @@ import (
 	"mgarnier11.fr/go/libs/logger"
 	"mgarnier11.fr/go/libs/utils"
 
+	"mgarnier11.fr/go/go-proxy/acl"
 	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/events"
 	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/metrics"
+	"mgarnier11.fr/go/go-proxy/passive"
+	"mgarnier11.fr/go/go-proxy/probe"
+	"mgarnier11.fr/go/go-proxy/proxyProtocol"
 
 	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/time/rate"
 )
 
 type TCPProxy struct {
-	Name           string
-	ListenAddr     *net.TCPAddr
-	ServerAddr     *net.TCPAddr
-	StartHost      func(proxyName string) error
-	PacketReceived func(proxyName string)
+	Name       string
+	ListenAddr *net.TCPAddr
+	ServerAddr *net.TCPAddr
+	StartHost  func(reason hostState.Reason) error
 
 	logger *logger.Logger
 
-	hostState *hostState.State
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
+	hostState        *hostState.Machine
+	startTimeout     time.Duration
+	readinessProbe   probe.Probe
+	readinessTimeout time.Duration
+	http             bool
+	// Proxy protocol version sent to the server, empty when disabled
+	sendProxyProtocol   string
+	acceptProxyProtocol bool
+	// Peers allowed to send the proxy protocol header, the others are rejected
+	trustedProxies *acl.List
+	// Lowercase names routed to the proxy by the shared listener of its port, empty when the proxy has its own listener
+	hostnames       []string
+	hostName        string
+	key             string
+	config          *config.ProxyConfig
+	passive         *passive.Passive
+	activity        *activityTracker
+	limiter         *connectionLimiter
+	uploadLimiter   *rate.Limiter
+	downloadLimiter *rate.Limiter
+	wg              sync.WaitGroup
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	// Cancelled to close the listener, while ctx closes the connections
+	acceptCtx     context.Context
+	stopAccepting context.CancelFunc
+
+	accessFilter
+	listenerRelease
 }
 
-type TCPProxyArgs struct {
-	HostIp         string
-	ProxyConfig    *config.ProxyConfig
-	HostState      *hostState.State
-	StartHost      func(proxyName string) error
-	PacketReceived func(proxyName string)
-}
-
-func NewTCPProxy(args *TCPProxyArgs, hostLogger *logger.Logger) *TCPProxy {
-	ctx, cancel := context.WithCancel(context.Background())
-
+func NewTCPProxy(args *ProxyArgs, hostLogger *logger.Logger) (*TCPProxy, error) {
 	logger := logger.NewLogger(fmt.Sprintf("[%s]", strings.ToUpper(args.ProxyConfig.Key)), "%-15s ", lipgloss.NewStyle().Foreground(lipgloss.Color(colors.GenerateHexColor(args.ProxyConfig.Name))), hostLogger)
 
 	listenAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", args.ProxyConfig.ListenPort))
 	if err != nil {
-		logger.Errorf("Failed to resolve listen TCP address %d: %v", args.ProxyConfig.ListenPort, err)
-		panic(err)
+		return nil, fmt.Errorf("failed to resolve listen TCP address %d: %v", args.ProxyConfig.ListenPort, err)
+	}
+
+	serverAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", args.Driver.ServerIp(), args.ProxyConfig.ServerPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server TCP address %d: %v", args.ProxyConfig.ServerPort, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acceptCtx, stopAccepting := context.WithCancel(ctx)
+
+	readinessProbe, err := newReadinessProbe(args)
+	if err != nil {
+		logger.Errorf("Invalid readiness probe, ignoring it: %v", err)
 	}
 
-	serverAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", args.HostIp, args.ProxyConfig.ServerPort))
+	passiveResponders, err := passive.NewPassive(args.ProxyConfig.Passive, serverAddr.String(), args.HostState)
 	if err != nil {
-		logger.Errorf("Failed to resolve server TCP address %d: %v", args.ProxyConfig.ServerPort, err)
-		panic(err)
+		logger.Errorf("Invalid passive config, ignoring it: %v", err)
+		passiveResponders, _ = passive.NewPassive(nil, serverAddr.String(), args.HostState)
 	}
 
 	tcpProxy := &TCPProxy{
-		Name:           args.ProxyConfig.Name,
-		ListenAddr:     listenAddr,
-		ServerAddr:     serverAddr,
-		StartHost:      args.StartHost,
-		PacketReceived: args.PacketReceived,
-		logger:         logger,
-		hostState:      args.HostState,
-		wg:             sync.WaitGroup{},
-		ctx:            ctx,
-		cancel:         cancel,
+		Name:                args.ProxyConfig.Name,
+		ListenAddr:          listenAddr,
+		ServerAddr:          serverAddr,
+		StartHost:           args.StartHost,
+		logger:              logger,
+		hostState:           args.HostState,
+		startTimeout:        args.HostConfig.GetStartTimeout(),
+		readinessProbe:      readinessProbe,
+		readinessTimeout:    getReadinessTimeout(args.ProxyConfig),
+		http:                args.ProxyConfig.Http,
+		sendProxyProtocol:   args.ProxyConfig.SendProxyProtocol,
+		acceptProxyProtocol: args.ProxyConfig.AcceptProxyProtocol,
+		trustedProxies:      newTrustedProxies(args.ProxyConfig.TrustedProxies, logger),
+		hostnames:           normalizeHostnames(args.ProxyConfig.Hostnames),
+		passive:             passiveResponders,
+		activity:            newProxyActivityTracker(ctx, args, logger),
+		limiter:             newConnectionLimiter(args.ProxyConfig.Limits),
+		uploadLimiter:       newBandwidthLimiter(getLimits(args.ProxyConfig).UploadBytesPerSecond),
+		downloadLimiter:     newBandwidthLimiter(getLimits(args.ProxyConfig).DownloadBytesPerSecond),
+		hostName:            args.HostConfig.Name,
+		key:                 args.ProxyConfig.Key,
+		config:              args.ProxyConfig,
+		wg:                  sync.WaitGroup{},
+		acceptCtx:           acceptCtx,
+		stopAccepting:       stopAccepting,
+		ctx:                 ctx,
+		cancel:              cancel,
 	}
 
+	tcpProxy.SetAccessList(args.AccessList)
+
 	logger.Infof("TCP Proxy created: %s -> %s", tcpProxy.ListenAddr, tcpProxy.ServerAddr)
 
-	return tcpProxy
+	return tcpProxy, nil
 }
 
 func (proxy *TCPProxy) Start(hostWaitGroup *sync.WaitGroup) {
@@ -85,6 +138,13 @@ func (proxy *TCPProxy) Start(hostWaitGroup *sync.WaitGroup) {
 		hostWaitGroup.Done()
 		proxy.wg.Done()
 	}()
+	// Registered first so that it runs once the listener is closed
+	defer proxy.releaseListener()
+
+	if len(proxy.hostnames) > 0 {
+		proxy.startShared()
+		return
+	}
 
 	listener, err := net.ListenTCP("tcp", proxy.ListenAddr)
 	if err != nil {
@@ -97,7 +157,7 @@ func (proxy *TCPProxy) Start(hostWaitGroup *sync.WaitGroup) {
 
 	stopChan := make(chan struct{})
 	go func() {
-		<-proxy.ctx.Done()
+		<-proxy.acceptCtx.Done()
 		proxy.logger.Infof("Stopping TCP proxy on %s", proxy.ListenAddr)
 		close(stopChan)
 		listener.Close() // Débloque listener.AcceptTCP(), qui passe dans le stopChan qui return la fonction, ce qui appelle tous les defer
@@ -115,72 +175,218 @@ func (proxy *TCPProxy) Start(hostWaitGroup *sync.WaitGroup) {
 				continue
 			}
 		}
-		proxy.logger.Debugf("Accepted connection from %s", clientConn.RemoteAddr())
 
 		proxy.wg.Add(1)
 		go proxy.handleTCPConnection(clientConn)
 	}
 }
 
-func (proxy *TCPProxy) Stop() {
+// startShared routes the connections of the shared listener to the proxy until it is stopped
+func (proxy *TCPProxy) startShared() {
+	if err := registerSharedProxy(proxy); err != nil {
+		proxy.logger.Errorf("Failed to start TCP proxy on the shared listener: %v", err)
+		return
+	}
+
+	proxy.logger.Debugf("TCP proxy started on the shared listener %s for %s", proxy.ListenAddr, strings.Join(proxy.hostnames, ", "))
+
+	<-proxy.acceptCtx.Done()
+
+	proxy.logger.Infof("Stopping TCP proxy on the shared listener %s", proxy.ListenAddr)
+	unregisterSharedProxy(proxy)
+}
+
+func (proxy *TCPProxy) GetConfig() *config.ProxyConfig {
+	return proxy.config
+}
+
+func (proxy *TCPProxy) Stop(drainTimeout time.Duration) {
 	proxy.logger.Infof("Stopping TCP proxy")
+	proxy.stopAccepting()
+
+	if !drainConnections(proxy.limiter, drainTimeout) {
+		proxy.logger.Infof("Closing the connections still open after %s", drainTimeout)
+	}
+
 	proxy.cancel()
 
 	proxy.wg.Wait()
+	// A proxy stopped before it started never releases its listener
+	proxy.releaseListener()
 }
 
-func (proxy *TCPProxy) shouldForwardProxy(peekBuffer []byte) (bool, error) {
+// shouldForwardProxy wakes the host if needed, it returns false when the connection was answered without the server
+func (proxy *TCPProxy) shouldForwardProxy(clientConn net.Conn, peekBuffer []byte, ignored bool) (bool, error) {
 	proxy.logger.Debugf("Checking if proxy should be forwarded, state: %s", proxy.hostState.String())
 
-	if *proxy.hostState == hostState.Stopped || *proxy.hostState == hostState.Stopping {
-		proxy.logger.Debugf("Host is stopped or stopping")
+	hostStarted := proxy.hostState.Is(hostState.Started)
 
-		if utils.IsHTTPRequest(peekBuffer) {
-			request := string(peekBuffer)
+	if responder := proxy.passive.FindResponder(peekBuffer, hostStarted); responder != nil {
+		proxy.logger.Debugf("Connection answered by the %s responder", responder.String())
 
-			if utils.CheckRequestHeader(request, "Status", "true") {
-				proxy.logger.Debugf("Status request")
-				return false, nil
-			} else {
-				proxy.logger.Debugf("Not a status request")
-			}
-		} else {
-			proxy.logger.Debugf("Not an HTTP request")
+		if err := responder.Respond(clientConn, peekBuffer); err != nil {
+			return false, fmt.Errorf("%s responder failed: %v", responder.String(), err)
 		}
 
-		proxy.PacketReceived(proxy.Name)
-		err := proxy.StartHost(proxy.Name)
+		return false, nil
+	}
+
+	if !hostStarted && ignored {
+		proxy.logger.Debugf("Connection from %s ignored, not waking host", clientConn.RemoteAddr())
+		return false, nil
+	}
 
-		if err != nil {
-			return false, fmt.Errorf("failed to start host: %v", err)
-		}
+	if proxy.http && utils.IsHTTPRequest(peekBuffer) && proxy.serveHoldingPage(clientConn, string(peekBuffer)) {
+		return false, nil
+	}
+
+	woken, err := wakeHost(hostState.ProxyReason(proxy.Name, clientConn.RemoteAddr().String()), proxy.hostState, proxy.StartHost, func() {
+		proxy.activity.wakeRequested(clientConn.RemoteAddr())
+	}, proxy.startTimeout)
+
+	if err != nil {
+		return false, err
+	}
+
+	// Without a configured probe, the server port is only checked when the host just woke up
+	readinessProbe := proxy.readinessProbe
+	if readinessProbe == nil && woken {
+		readinessProbe = probe.NewTcpProbe(proxy.ServerAddr.String())
 	}
 
-	hostStarted := hostState.WaitForState(proxy.hostState, hostState.Started, 20*time.Second)
+	if readinessProbe != nil && isServerStarting(woken, proxy.hostState, proxy.readinessTimeout) {
+		proxy.logger.Debugf("Waiting for %s to be ready", readinessProbe.String())
 
-	if !hostStarted {
-		return false, fmt.Errorf("host took too long to start")
+		if err := probe.WaitReady(proxy.ctx, readinessProbe, proxy.readinessTimeout); err != nil {
+			return false, err
+		}
 	}
 
 	return true, nil
 }
 
-func (proxy *TCPProxy) handleTCPConnection(clientConn *net.TCPConn) {
+// serveHoldingPage answers with the holding page while the host or its server is not ready, it reports whether the page was served
+func (proxy *TCPProxy) serveHoldingPage(clientConn net.Conn, request string) bool {
+	var message string
+
+	if !proxy.hostState.Is(hostState.Started) {
+		proxy.activity.wakeRequested(clientConn.RemoteAddr())
+
+		if proxy.hostState.Is(hostState.Stopped, hostState.Stopping) {
+			go func() {
+				if err := proxy.StartHost(hostState.ProxyReason(proxy.Name, clientConn.RemoteAddr().String())); err != nil {
+					proxy.logger.Errorf("Failed to start host: %v", err)
+				}
+			}()
+		}
+
+		message = fmt.Sprintf("Host is %s", strings.ToLower(proxy.hostState.String()))
+	} else if time.Since(proxy.hostState.ChangedAt()) < proxy.readinessTimeout {
+		readinessProbe := proxy.readinessProbe
+		if readinessProbe == nil {
+			readinessProbe = probe.NewTcpProbe(proxy.ServerAddr.String())
+		}
+
+		if readinessProbe.Check() == nil {
+			return false
+		}
+
+		message = "Waiting for the service to be ready"
+	} else {
+		return false
+	}
+
+	proxy.logger.Debugf("Serving holding page: %s", message)
+
+	data := newHoldingPageData(proxy.hostName, proxy.hostState, proxy.startTimeout, message)
+
+	if err := writeHoldingPage(clientConn, request, data); err != nil {
+		proxy.logger.Errorf("Failed to write holding page: %v", err)
+	}
+
+	return true
+}
+
+// acceptConnection returns the connection with the client address sent in the proxy protocol header, when it is expected
+func (proxy *TCPProxy) acceptConnection(tcpConn *net.TCPConn) (net.Conn, error) {
+	if !proxy.acceptProxyProtocol {
+		return tcpConn, nil
+	}
+
+	if !isTrustedProxy(proxy.trustedProxies, tcpConn.RemoteAddr()) {
+		return nil, fmt.Errorf("proxy protocol header not accepted from untrusted peer %s", tcpConn.RemoteAddr())
+	}
+
+	proxyConn, err := proxyProtocol.ReadHeader(tcpConn, proxyProtocolTimeout)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol header from %s: %v", tcpConn.RemoteAddr(), err)
+	}
+
+	return proxyConn, nil
+}
+
+func (proxy *TCPProxy) handleTCPConnection(tcpConn *net.TCPConn) {
 	defer proxy.wg.Done()
-	defer clientConn.Close()
+	defer tcpConn.Close()
 
-	peekBuffer := make([]byte, 512)
-	bytesRead, err := clientConn.Read(peekBuffer)
+	clientConn, err := proxy.acceptConnection(tcpConn)
 
 	if err != nil {
-		proxy.logger.Errorf("Failed to read data from client: %v", err)
+		proxy.logger.Errorf("Failed to accept connection: %v", err)
 		return
 	}
 
-	proxy.logger.Verbosef("Read %d bytes from client", bytesRead)
+	proxy.handleClient(clientConn, nil)
+}
 
-	peekBuffer = peekBuffer[:bytesRead]
-	forwardProxy, err := proxy.shouldForwardProxy(peekBuffer)
+// handleClient forwards the client to the server, the first bytes of the client are read when peekBuffer is nil
+func (proxy *TCPProxy) handleClient(clientConn net.Conn, peekBuffer []byte) {
+	// Closed before reading the client data, so a denied client can not wake the host
+	if !proxy.allows(clientConn.RemoteAddr()) {
+		proxy.logger.Infof("Connection from %s denied by the access list", clientConn.RemoteAddr())
+		metrics.ConnectionDenied(proxy.hostName, proxy.key)
+		return
+	}
+
+	if reason := proxy.limiter.acquire(clientConn.RemoteAddr()); reason != "" {
+		proxy.logger.Debugf("Connection from %s rejected: %s", clientConn.RemoteAddr(), reason)
+		metrics.ConnectionRejected(proxy.hostName, proxy.key, reason)
+		return
+	}
+	defer proxy.limiter.release(clientConn.RemoteAddr())
+
+	proxy.logger.Debugf("Accepted connection from %s", clientConn.RemoteAddr())
+
+	metrics.ConnectionOpened(proxy.hostName, proxy.key)
+	defer metrics.ConnectionClosed(proxy.hostName, proxy.key)
+
+	connectionData := &events.ConnectionData{
+		Proxy:      proxy.key,
+		Protocol:   config.ProtocolTCP,
+		ClientAddr: clientConn.RemoteAddr().String(),
+	}
+
+	events.Publish(events.ConnectionOpened, proxy.hostName, connectionData)
+	defer events.Publish(events.ConnectionClosed, proxy.hostName, connectionData)
+
+	if peekBuffer == nil {
+		peekBuffer = make([]byte, 512)
+		bytesRead, err := clientConn.Read(peekBuffer)
+
+		if err != nil {
+			proxy.logger.Errorf("Failed to read data from client: %v", err)
+			return
+		}
+
+		proxy.logger.Verbosef("Read %d bytes from client", bytesRead)
+
+		peekBuffer = peekBuffer[:bytesRead]
+	}
+
+	ignored := proxy.passive.IsIgnored(clientConn.RemoteAddr(), peekBuffer)
+
+	forwardProxy, err := proxy.shouldForwardProxy(clientConn, peekBuffer, ignored)
 
 	if err != nil {
 		proxy.logger.Errorf("Failed to determine if proxy should be forwarded: %v", err)
@@ -188,7 +394,7 @@ func (proxy *TCPProxy) handleTCPConnection(clientConn *net.TCPConn) {
 	}
 
 	if !forwardProxy {
-		proxy.logger.Verbosef("Proxy not forwarded to server, status request")
+		proxy.logger.Verbosef("Proxy not forwarded to server")
 		return
 	}
 
@@ -203,6 +409,13 @@ func (proxy *TCPProxy) handleTCPConnection(clientConn *net.TCPConn) {
 	proxy.logger.Debugf("Connected to server %s", proxy.ServerAddr)
 	defer serverConn.Close()
 
+	if proxy.sendProxyProtocol != "" {
+		if err := proxyProtocol.WriteHeader(serverConn, proxy.sendProxyProtocol, clientConn.RemoteAddr(), clientConn.LocalAddr()); err != nil {
+			proxy.logger.Errorf("Error writing proxy protocol header to server: %v", err)
+			return
+		}
+	}
+
 	_, err = serverConn.Write(peekBuffer)
 	if err != nil {
 		proxy.logger.Errorf("Error writing peek buffer to server: %v", err)
@@ -210,20 +423,32 @@ func (proxy *TCPProxy) handleTCPConnection(clientConn *net.TCPConn) {
 
 	proxy.logger.Debugf("Wrote peek buffer to server")
 
+	if !ignored {
+		proxy.activity.connectionOpened(clientConn.RemoteAddr())
+		defer proxy.activity.connectionClosed(clientConn.RemoteAddr())
+		proxy.activity.bytesReceived(clientConn.RemoteAddr(), len(peekBuffer))
+	}
+
 	// Fonction qui va être appelée à chaque fois que des données sont transférées du client vers le serveur
 	onClientToServer := func(bytesTransferred int) {
 		proxy.logger.Verbosef("ClientToServer: %d bytes", bytesTransferred)
 
-		proxy.PacketReceived(proxy.Name)
+		metrics.ClientToServerBytes(proxy.hostName, proxy.key, bytesTransferred)
+
+		if !ignored {
+			proxy.activity.bytesReceived(clientConn.RemoteAddr(), bytesTransferred)
+		}
 	}
 
 	// Fonction qui va être appelée à chaque fois que des données sont transférées du serveur vers le client
 	onServerToClient := func(bytesTransferred int) {
 		proxy.logger.Verbosef("ServerToClient: %d bytes", bytesTransferred)
+
+		metrics.ServerToClientBytes(proxy.hostName, proxy.key, bytesTransferred)
 	}
 
-	clientToServerWriter := &utils.CustomWriter{Writer: serverConn, OnWrite: onClientToServer}
-	serverToClientWriter := &utils.CustomWriter{Writer: clientConn, OnWrite: onServerToClient}
+	clientToServerWriter := &utils.CustomWriter{Writer: newShapedWriter(proxy.ctx, serverConn, proxy.uploadLimiter), OnWrite: onClientToServer}
+	serverToClientWriter := &utils.CustomWriter{Writer: newShapedWriter(proxy.ctx, clientConn, proxy.downloadLimiter), OnWrite: onServerToClient}
 
 	// Channel pour savoir quand la copie client -> serveur est terminée
 	doneCopyClientToServer := make(chan struct{})
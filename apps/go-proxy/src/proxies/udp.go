@@ -2,75 +2,473 @@ package proxies
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"mgarnier11.fr/go/libs/colors"
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/events"
+	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/metrics"
+	"mgarnier11.fr/go/go-proxy/passive"
+	"mgarnier11.fr/go/go-proxy/probe"
+
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/time/rate"
+)
+
+const (
+	udpBufferSize            = 64 * 1024
+	udpSessionQueueSize      = 64
+	defaultUDPSessionTimeout = 60 * time.Second
+	// Sessions have no end, while draining they are closed once idle for this long instead of waiting for SessionTimeout
+	udpDrainIdleTimeout = 2 * time.Second
 )
 
+// udpSession holds the connection to the server used for one client address
+type udpSession struct {
+	clientAddr   *net.UDPAddr
+	serverConn   *net.UDPConn
+	packets      chan []byte
+	lastActivity time.Time
+	// Ignored sessions never wake the host nor count as activity
+	ignored bool
+
+	mutex  sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (session *udpSession) touch() {
+	session.mutex.Lock()
+	session.lastActivity = time.Now()
+	session.mutex.Unlock()
+}
+
+func (session *udpSession) idleSince() time.Duration {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return time.Since(session.lastActivity)
+}
+
 type UDPProxy struct {
-	ListenAddr string
-	TargetAddr string
-	UDPConn    *net.UDPConn
-	Cancel     context.CancelFunc
+	Name           string
+	ListenAddr     *net.UDPAddr
+	ServerAddr     *net.UDPAddr
+	SessionTimeout time.Duration
+	StartHost      func(reason hostState.Reason) error
+
+	logger *logger.Logger
+
+	hostState        *hostState.Machine
+	startTimeout     time.Duration
+	readinessProbe   probe.Probe
+	readinessTimeout time.Duration
+	passive          *passive.Passive
+	activity         *activityTracker
+	limiter          *connectionLimiter
+	uploadLimiter    *rate.Limiter
+	downloadLimiter  *rate.Limiter
+	hostName         string
+	key              string
+	config           *config.ProxyConfig
+	listener         *net.UDPConn
+	sessions         map[string]*udpSession
+	sessionMutex     sync.Mutex
+	wg               sync.WaitGroup
+	ctx              context.Context
+	cancel           context.CancelFunc
+
+	// Set when the proxy is stopping, the existing sessions are kept but no new one is created
+	draining atomic.Bool
+
+	accessFilter
+	listenerRelease
+}
+
+func NewUDPProxy(args *ProxyArgs, hostLogger *logger.Logger) (*UDPProxy, error) {
+	logger := logger.NewLogger(fmt.Sprintf("[%s]", strings.ToUpper(args.ProxyConfig.Key)), "%-15s ", lipgloss.NewStyle().Foreground(lipgloss.Color(colors.GenerateHexColor(args.ProxyConfig.Name))), hostLogger)
+
+	listenAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", "0.0.0.0", args.ProxyConfig.ListenPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve listen UDP address %d: %v", args.ProxyConfig.ListenPort, err)
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", args.Driver.ServerIp(), args.ProxyConfig.ServerPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server UDP address %d: %v", args.ProxyConfig.ServerPort, err)
+	}
+
+	sessionTimeout := defaultUDPSessionTimeout
+	if args.ProxyConfig.UDPSessionTimeout > 0 {
+		sessionTimeout = time.Duration(args.ProxyConfig.UDPSessionTimeout) * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	readinessProbe, err := newReadinessProbe(args)
+	if err != nil {
+		logger.Errorf("Invalid readiness probe, ignoring it: %v", err)
+	}
+
+	passiveRules, err := passive.NewPassive(args.ProxyConfig.Passive, serverAddr.String(), args.HostState)
+	if err != nil {
+		logger.Errorf("Invalid passive config, ignoring it: %v", err)
+		passiveRules, _ = passive.NewPassive(nil, serverAddr.String(), args.HostState)
+	}
+
+	udpProxy := &UDPProxy{
+		Name:             args.ProxyConfig.Name,
+		ListenAddr:       listenAddr,
+		ServerAddr:       serverAddr,
+		SessionTimeout:   sessionTimeout,
+		StartHost:        args.StartHost,
+		logger:           logger,
+		hostState:        args.HostState,
+		startTimeout:     args.HostConfig.GetStartTimeout(),
+		readinessProbe:   readinessProbe,
+		readinessTimeout: getReadinessTimeout(args.ProxyConfig),
+		passive:          passiveRules,
+		activity:         newProxyActivityTracker(ctx, args, logger),
+		limiter:          newConnectionLimiter(args.ProxyConfig.Limits),
+		uploadLimiter:    newBandwidthLimiter(getLimits(args.ProxyConfig).UploadBytesPerSecond),
+		downloadLimiter:  newBandwidthLimiter(getLimits(args.ProxyConfig).DownloadBytesPerSecond),
+		hostName:         args.HostConfig.Name,
+		key:              args.ProxyConfig.Key,
+		config:           args.ProxyConfig,
+		sessions:         make(map[string]*udpSession),
+		wg:               sync.WaitGroup{},
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+
+	udpProxy.SetAccessList(args.AccessList)
+
+	logger.Infof("UDP Proxy created: %s -> %s", udpProxy.ListenAddr, udpProxy.ServerAddr)
+
+	return udpProxy, nil
 }
 
-func StartUDPProxy(config *UDPProxy, wg *sync.WaitGroup, ctx context.Context) {
-	defer wg.Done()
+func (proxy *UDPProxy) Start(hostWaitGroup *sync.WaitGroup) {
+	hostWaitGroup.Add(1)
+	proxy.wg.Add(1)
+	defer func() {
+		proxy.logger.Infof("UDP proxy stopped")
+		hostWaitGroup.Done()
+		proxy.wg.Done()
+	}()
+	// Registered first so that it runs once the listener is closed
+	defer proxy.releaseListener()
 
-	targetAddr, err := net.ResolveUDPAddr("udp", config.TargetAddr)
+	listener, err := net.ListenUDP("udp", proxy.ListenAddr)
 	if err != nil {
-		log.Fatalf("Failed to resolve target address %s: %v", config.TargetAddr, err)
+		proxy.logger.Errorf("Failed to start UDP proxy: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	proxy.listener = listener
+
+	proxy.logger.Debugf("UDP proxy started on %s", proxy.ListenAddr)
+
+	go func() {
+		<-proxy.ctx.Done()
+		proxy.logger.Infof("Stopping UDP proxy on %s", proxy.ListenAddr)
+		listener.Close() // Unblocks listener.ReadFromUDP so the read loop can return
+	}()
+
+	proxy.wg.Add(1)
+	go proxy.expireSessions()
+
+	buffer := make([]byte, udpBufferSize)
+	for {
+		bytesRead, clientAddr, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			if proxy.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				proxy.logger.Infof("Stopped reading datagrams on %s", proxy.ListenAddr)
+				proxy.closeSessions()
+				return
+			}
+
+			proxy.logger.Errorf("Failed to read from client: %v", err)
+			continue
+		}
+
+		packet := make([]byte, bytesRead)
+		copy(packet, buffer[:bytesRead])
+
+		proxy.dispatchPacket(clientAddr, packet)
+	}
+}
+
+func (proxy *UDPProxy) GetConfig() *config.ProxyConfig {
+	return proxy.config
+}
+
+func (proxy *UDPProxy) Stop(drainTimeout time.Duration) {
+	proxy.logger.Infof("Stopping UDP proxy")
+	proxy.draining.Store(true)
+
+	if !proxy.drainSessions(drainTimeout) {
+		proxy.logger.Infof("Closing the sessions still open after %s", drainTimeout)
+	}
+
+	proxy.cancel()
+
+	proxy.wg.Wait()
+	// A proxy stopped before it started never releases its listener
+	proxy.releaseListener()
+}
+
+// dispatchPacket queues the packet on the session of the client, creating it if needed
+func (proxy *UDPProxy) dispatchPacket(clientAddr *net.UDPAddr, packet []byte) {
+	proxy.sessionMutex.Lock()
+	session, exists := proxy.sessions[clientAddr.String()]
+
+	if !exists {
+		if proxy.draining.Load() {
+			proxy.sessionMutex.Unlock()
+			proxy.logger.Debugf("Datagram from %s dropped, proxy stopping", clientAddr)
+			return
+		}
+
+		if !proxy.allows(clientAddr) {
+			proxy.sessionMutex.Unlock()
+			proxy.logger.Debugf("Datagram from %s denied by the access list", clientAddr)
+			metrics.ConnectionDenied(proxy.hostName, proxy.key)
+			return
+		}
+
+		ignored := proxy.passive.IsIgnored(clientAddr, packet)
+
+		if ignored && !proxy.hostState.Is(hostState.Started) {
+			proxy.sessionMutex.Unlock()
+			proxy.logger.Debugf("Datagram from %s ignored, not waking host", clientAddr)
+			return
+		}
+
+		if reason := proxy.limiter.acquire(clientAddr); reason != "" {
+			proxy.sessionMutex.Unlock()
+			proxy.logger.Debugf("Session from %s rejected: %s", clientAddr, reason)
+			metrics.ConnectionRejected(proxy.hostName, proxy.key, reason)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(proxy.ctx)
+
+		session = &udpSession{
+			clientAddr:   clientAddr,
+			packets:      make(chan []byte, udpSessionQueueSize),
+			lastActivity: time.Now(),
+			ignored:      ignored,
+			ctx:          ctx,
+			cancel:       cancel,
+		}
+
+		proxy.sessions[clientAddr.String()] = session
+
+		proxy.logger.Debugf("New session for %s", clientAddr)
+
+		metrics.ConnectionOpened(proxy.hostName, proxy.key)
+		events.Publish(events.ConnectionOpened, proxy.hostName, proxy.newConnectionData(clientAddr))
+
+		proxy.wg.Add(1)
+		go proxy.handleSession(session)
 	}
+	proxy.sessionMutex.Unlock()
+
+	session.touch()
+
+	select {
+	case session.packets <- packet:
+	default:
+		proxy.logger.Warnf("Session queue full for %s, dropping datagram", clientAddr)
+	}
+}
+
+func (proxy *UDPProxy) handleSession(session *udpSession) {
+	defer proxy.wg.Done()
+	defer proxy.removeSession(session)
+
+	// The first datagram of a session wakes the host, the following ones are queued meanwhile
+	woken, err := wakeHost(hostState.ProxyReason(proxy.Name, session.clientAddr.String()), proxy.hostState, proxy.StartHost, func() {
+		proxy.activity.wakeRequested(session.clientAddr)
+	}, proxy.startTimeout)
 
-	listenAddr, err := net.ResolveUDPAddr("udp", config.ListenAddr)
 	if err != nil {
-		log.Fatalf("Failed to resolve listen address %s: %v", config.ListenAddr, err)
+		proxy.logger.Errorf("Failed to start host for %s: %v", session.clientAddr, err)
+		return
 	}
 
-	conn, err := net.ListenUDP("udp", listenAddr)
+	if proxy.readinessProbe != nil && isServerStarting(woken, proxy.hostState, proxy.readinessTimeout) {
+		if err := probe.WaitReady(session.ctx, proxy.readinessProbe, proxy.readinessTimeout); err != nil {
+			proxy.logger.Errorf("Server not ready for %s: %v", session.clientAddr, err)
+			return
+		}
+	}
+
+	serverConn, err := net.DialUDP("udp", nil, proxy.ServerAddr)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", config.ListenAddr, err)
+		proxy.logger.Errorf("Failed to connect to server: %v", err)
+		return
 	}
-	config.UDPConn = conn
-	defer conn.Close()
+	defer serverConn.Close()
+
+	session.serverConn = serverConn
+
+	proxy.logger.Infof("Session %s forwarded to server %s", session.clientAddr, proxy.ServerAddr)
+
+	go proxy.copyServerToClient(session)
 
-	log.Printf("UDP proxy listening on %s, forwarding to %s", config.ListenAddr, config.TargetAddr)
+	if !session.ignored {
+		proxy.activity.connectionOpened(session.clientAddr)
+		defer proxy.activity.connectionClosed(session.clientAddr)
+	}
 
-	buf := make([]byte, 2048)
 	for {
 		select {
-		case <-ctx.Done():
-			log.Printf("Shutting down UDP proxy on %s", config.ListenAddr)
+		case <-session.ctx.Done():
+			proxy.logger.Debugf("Session %s closed", session.clientAddr)
 			return
-		default:
-			conn.SetReadDeadline(time.Now().Add(1 * time.Second)) // Use timeout to allow checking for context cancelation
-			n, clientAddr, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				log.Printf("Failed to read from client: %v", err)
-				continue
+		case packet := <-session.packets:
+			if err := waitBandwidth(session.ctx, proxy.uploadLimiter, len(packet)); err != nil {
+				proxy.logger.Debugf("Session %s closed", session.clientAddr)
+				return
 			}
 
-			_, err = conn.WriteToUDP(buf[:n], targetAddr)
+			_, err := serverConn.Write(packet)
 			if err != nil {
-				log.Printf("Failed to write to target %s: %v", config.TargetAddr, err)
+				proxy.logger.Errorf("Error writing to server: %v", err)
 				continue
 			}
 
-			n, _, err = conn.ReadFromUDP(buf)
-			if err != nil {
-				log.Printf("Failed to read from target: %v", err)
-				continue
+			proxy.logger.Verbosef("ClientToServer: %d bytes", len(packet))
+
+			metrics.ClientToServerBytes(proxy.hostName, proxy.key, len(packet))
+
+			session.touch()
+
+			if !session.ignored {
+				proxy.activity.bytesReceived(session.clientAddr, len(packet))
 			}
+		}
+	}
+}
 
-			_, err = conn.WriteToUDP(buf[:n], clientAddr)
-			if err != nil {
-				log.Printf("Failed to write to client: %v", err)
-				continue
+func (proxy *UDPProxy) copyServerToClient(session *udpSession) {
+	buffer := make([]byte, udpBufferSize)
+
+	for {
+		bytesRead, err := session.serverConn.Read(buffer)
+		if err != nil {
+			if session.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
 			}
+
+			// Connected UDP sockets report ICMP errors (port unreachable...) on read, keep the session alive
+			proxy.logger.Debugf("Error reading from server for %s: %v", session.clientAddr, err)
+			continue
+		}
+
+		if err := waitBandwidth(session.ctx, proxy.downloadLimiter, bytesRead); err != nil {
+			return
 		}
+
+		_, err = proxy.listener.WriteToUDP(buffer[:bytesRead], session.clientAddr)
+		if err != nil {
+			proxy.logger.Errorf("Error writing to client %s: %v", session.clientAddr, err)
+			continue
+		}
+
+		proxy.logger.Verbosef("ServerToClient: %d bytes", bytesRead)
+
+		metrics.ServerToClientBytes(proxy.hostName, proxy.key, bytesRead)
+
+		session.touch()
+	}
+}
+
+// expireSessions closes the sessions that did not see any traffic during SessionTimeout
+func (proxy *UDPProxy) expireSessions() {
+	defer proxy.wg.Done()
+
+	ticker := time.NewTicker(proxy.SessionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proxy.ctx.Done():
+			return
+		case <-ticker.C:
+			proxy.closeIdleSessions(proxy.SessionTimeout)
+		}
+	}
+}
+
+// drainSessions waits for the sessions to be closed, closing them once idle for udpDrainIdleTimeout, and returns false on timeout
+func (proxy *UDPProxy) drainSessions(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for proxy.limiter.count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		proxy.closeIdleSessions(min(udpDrainIdleTimeout, proxy.SessionTimeout))
+		time.Sleep(drainPollInterval)
+	}
+
+	return true
+}
+
+// closeIdleSessions closes the sessions that did not see any traffic during idleTimeout
+func (proxy *UDPProxy) closeIdleSessions(idleTimeout time.Duration) {
+	proxy.sessionMutex.Lock()
+	defer proxy.sessionMutex.Unlock()
+
+	for _, session := range proxy.sessions {
+		if session.idleSince() > idleTimeout {
+			proxy.logger.Debugf("Session %s expired", session.clientAddr)
+			session.cancel()
+		}
+	}
+}
+
+func (proxy *UDPProxy) removeSession(session *udpSession) {
+	session.cancel()
+
+	proxy.sessionMutex.Lock()
+	if proxy.sessions[session.clientAddr.String()] == session {
+		delete(proxy.sessions, session.clientAddr.String())
+	}
+	proxy.sessionMutex.Unlock()
+
+	proxy.limiter.release(session.clientAddr)
+	metrics.ConnectionClosed(proxy.hostName, proxy.key)
+	events.Publish(events.ConnectionClosed, proxy.hostName, proxy.newConnectionData(session.clientAddr))
+}
+
+func (proxy *UDPProxy) newConnectionData(clientAddr *net.UDPAddr) *events.ConnectionData {
+	return &events.ConnectionData{
+		Proxy:      proxy.key,
+		Protocol:   config.ProtocolUDP,
+		ClientAddr: clientAddr.String(),
+	}
+}
+
+func (proxy *UDPProxy) closeSessions() {
+	proxy.sessionMutex.Lock()
+	defer proxy.sessionMutex.Unlock()
+
+	for _, session := range proxy.sessions {
+		session.cancel()
 	}
 }
@@ -0,0 +1,279 @@
+package proxyProtocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Version1 = "v1"
+	Version2 = "v2"
+)
+
+const (
+	// Longest v1 header, including the crlf
+	maxV1HeaderSize = 107
+	v2HeaderSize    = 16
+	v2CommandLocal  = 0x20
+	v2CommandProxy  = 0x21
+	v2FamilyTCP4    = 0x11
+	v2FamilyTCP6    = 0x21
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// IsValidVersion reports whether the version can be sent, an empty version disables the header
+func IsValidVersion(version string) bool {
+	switch version {
+	case "", Version1, Version2:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteHeader writes the header announcing a connection from sourceAddr to destinationAddr, tcp addresses of different
+// families are sent as ipv6 and other addresses as an unknown connection
+func WriteHeader(writer io.Writer, version string, sourceAddr net.Addr, destinationAddr net.Addr) error {
+	var header []byte
+
+	switch version {
+	case Version1:
+		header = newV1Header(sourceAddr, destinationAddr)
+	case Version2:
+		header = newV2Header(sourceAddr, destinationAddr)
+	default:
+		return fmt.Errorf("unknown proxy protocol version %s", version)
+	}
+
+	_, err := writer.Write(header)
+
+	return err
+}
+
+// getTCPAddrs returns the ips of the addresses with the same length, or nil when they are not tcp addresses
+func getTCPAddrs(sourceAddr net.Addr, destinationAddr net.Addr) (*net.TCPAddr, *net.TCPAddr, net.IP, net.IP) {
+	source, sourceOk := sourceAddr.(*net.TCPAddr)
+	destination, destinationOk := destinationAddr.(*net.TCPAddr)
+
+	if !sourceOk || !destinationOk {
+		return nil, nil, nil, nil
+	}
+
+	if sourceIp, destinationIp := source.IP.To4(), destination.IP.To4(); sourceIp != nil && destinationIp != nil {
+		return source, destination, sourceIp, destinationIp
+	}
+
+	return source, destination, source.IP.To16(), destination.IP.To16()
+}
+
+func newV1Header(sourceAddr net.Addr, destinationAddr net.Addr) []byte {
+	source, destination, sourceIp, destinationIp := getTCPAddrs(sourceAddr, destinationAddr)
+
+	if source == nil || sourceIp == nil || destinationIp == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if len(sourceIp) == net.IPv4len {
+		family = "TCP4"
+	}
+
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, sourceIp, destinationIp, source.Port, destination.Port)
+}
+
+func newV2Header(sourceAddr net.Addr, destinationAddr net.Addr) []byte {
+	header := bytes.Clone(v2Signature)
+	source, destination, sourceIp, destinationIp := getTCPAddrs(sourceAddr, destinationAddr)
+
+	if source == nil || sourceIp == nil || destinationIp == nil {
+		return append(header, v2CommandLocal, 0x00, 0x00, 0x00)
+	}
+
+	family := byte(v2FamilyTCP6)
+	if len(sourceIp) == net.IPv4len {
+		family = v2FamilyTCP4
+	}
+
+	header = append(header, v2CommandProxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(sourceIp)+4))
+	header = append(header, sourceIp...)
+	header = append(header, destinationIp...)
+	header = binary.BigEndian.AppendUint16(header, uint16(source.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(destination.Port))
+
+	return header
+}
+
+// Conn is a connection whose addresses come from the proxy protocol header sent by the client
+type Conn struct {
+	net.Conn
+	reader          *bufio.Reader
+	sourceAddr      net.Addr
+	destinationAddr net.Addr
+}
+
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	return conn.reader.Read(buffer)
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.sourceAddr
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.destinationAddr
+}
+
+// ReadHeader reads the v1 or v2 header at the start of the connection, the connection addresses are kept for a LOCAL or UNKNOWN header
+func ReadHeader(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	proxyConn := &Conn{
+		Conn:            conn,
+		reader:          bufio.NewReader(conn),
+		sourceAddr:      conn.RemoteAddr(),
+		destinationAddr: conn.LocalAddr(),
+	}
+
+	start, err := proxyConn.reader.Peek(len(v2Signature))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+
+	if bytes.Equal(start, v2Signature) {
+		err = proxyConn.readV2Header()
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		err = proxyConn.readV1Header()
+	} else {
+		err = errors.New("no proxy protocol header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return proxyConn, nil
+}
+
+func (conn *Conn) readV1Header() error {
+	line := []byte{}
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1HeaderSize {
+			return errors.New("v1 header too long")
+		}
+
+		char, err := conn.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read v1 header: %v", err)
+		}
+
+		line = append(line, char)
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	sourceAddr, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	destinationAddr, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	conn.sourceAddr = sourceAddr
+	conn.destinationAddr = destinationAddr
+
+	return nil
+}
+
+func parseV1Addr(rawIp string, rawPort string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(rawIp)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 header address %s", rawIp)
+	}
+
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 header port %s", rawPort)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func (conn *Conn) readV2Header() error {
+	header := make([]byte, v2HeaderSize)
+
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return fmt.Errorf("failed to read v2 header: %v", err)
+	}
+
+	command := header[12]
+	family := header[13]
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(conn.reader, addresses); err != nil {
+		return fmt.Errorf("failed to read v2 header addresses: %v", err)
+	}
+
+	switch command {
+	case v2CommandLocal:
+		return nil
+	case v2CommandProxy:
+	default:
+		return fmt.Errorf("invalid v2 header command %#x", command)
+	}
+
+	ipLength := 0
+
+	switch family {
+	case v2FamilyTCP4:
+		ipLength = net.IPv4len
+	case v2FamilyTCP6:
+		ipLength = net.IPv6len
+	default:
+		// Other families (udp, unix sockets) carry no tcp client address
+		return nil
+	}
+
+	if len(addresses) < 2*ipLength+4 {
+		return errors.New("v2 header addresses too short")
+	}
+
+	conn.sourceAddr = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(addresses[:ipLength])),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength:])),
+	}
+	conn.destinationAddr = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(addresses[ipLength : 2*ipLength])),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength+2:])),
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package proxyProtocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readHeader sends the data on a pipe and reads the header from the other end
+func readHeader(t *testing.T, data []byte) (*Conn, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	return ReadHeader(server, time.Second)
+}
+
+// newV2 returns a v2 header with the command, the family and the addresses, the length field matches the addresses
+func newV2(command byte, family byte, addresses []byte) []byte {
+	header := append(bytes.Clone(v2Signature), command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+
+	return append(header, addresses...)
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp4Addresses := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+
+	tests := []struct {
+		name string
+		data []byte
+		// Expected remote address, empty when the pipe address is kept
+		expected string
+		fails    bool
+	}{
+		{name: "v1 tcp4", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), expected: "192.0.2.1:12345"},
+		{name: "v1 tcp6", data: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), expected: "[2001:db8::1]:12345"},
+		{name: "v1 unknown", data: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", data: []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 443\r\n")},
+		{name: "v1 invalid ip", data: []byte("PROXY TCP4 192.0.2 198.51.100.1 12345 443\r\n"), fails: true},
+		{name: "v1 invalid port", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n"), fails: true},
+		{name: "v1 missing fields", data: []byte("PROXY TCP4 192.0.2.1\r\n"), fails: true},
+		{name: "v1 too long", data: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), maxV1HeaderSize)...), fails: true},
+		{name: "v1 truncated", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1"), fails: true},
+		{name: "v2 tcp4", data: newV2(v2CommandProxy, v2FamilyTCP4, tcp4Addresses), expected: "192.0.2.1:12345"},
+		{name: "v2 local", data: newV2(v2CommandLocal, 0x00, nil)},
+		{name: "v2 local with addresses", data: newV2(v2CommandLocal, v2FamilyTCP4, tcp4Addresses)},
+		{name: "v2 tcp4 addresses too short", data: newV2(v2CommandProxy, v2FamilyTCP4, tcp4Addresses[:8]), fails: true},
+		{name: "v2 tcp6 addresses too short", data: newV2(v2CommandProxy, v2FamilyTCP6, tcp4Addresses), fails: true},
+		{name: "v2 addresses truncated", data: newV2(v2CommandProxy, v2FamilyTCP4, tcp4Addresses)[:v2HeaderSize+4], fails: true},
+		{name: "v2 header truncated", data: newV2(v2CommandProxy, v2FamilyTCP4, tcp4Addresses)[:v2HeaderSize-2], fails: true},
+		{name: "v2 invalid command", data: newV2(0x22, v2FamilyTCP4, tcp4Addresses), fails: true},
+		{name: "no header", data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := readHeader(t, test.data)
+
+			if test.fails {
+				if err == nil {
+					t.Errorf("expected an error, got the remote address %s", conn.RemoteAddr())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := test.expected
+			if expected == "" {
+				expected = conn.Conn.RemoteAddr().String()
+			}
+
+			if remoteAddr := conn.RemoteAddr().String(); remoteAddr != expected {
+				t.Errorf("expected the remote address %s, got %s", expected, remoteAddr)
+			}
+		})
+	}
+}
+
+func TestReadHeaderKeepsData(t *testing.T) {
+	conn, err := readHeader(t, []byte("PROXY UNKNOWN\r\nhello"))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := io.ReadAll(conn)
+
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected the data following the header, got %q, %v", data, err)
+	}
+}
+
+func TestWriteHeaderRoundTrip(t *testing.T) {
+	sourceAddr := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}
+	destinationAddr := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	for _, version := range []string{Version1, Version2} {
+		t.Run(version, func(t *testing.T) {
+			header := &bytes.Buffer{}
+
+			if err := WriteHeader(header, version, sourceAddr, destinationAddr); err != nil {
+				t.Fatalf("failed to write the header: %v", err)
+			}
+
+			conn, err := readHeader(t, header.Bytes())
+
+			if err != nil {
+				t.Fatalf("failed to read the header: %v", err)
+			}
+
+			if conn.RemoteAddr().String() != sourceAddr.String() || conn.LocalAddr().String() != destinationAddr.String() {
+				t.Errorf("expected %s -> %s, got %s -> %s", sourceAddr, destinationAddr, conn.RemoteAddr(), conn.LocalAddr())
+			}
+		})
+	}
+}
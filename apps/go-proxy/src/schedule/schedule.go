@@ -0,0 +1,235 @@
+package schedule
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+const (
+	TypeKeepAwake  = "keepAwake"
+	TypeForceSleep = "forceSleep"
+	TypeWake       = "wake"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Transition is a scheduled change of the behavior of the host
+type Transition struct {
+	Type string `json:"type"`
+	// Event is start or end for windows, wake for wake entries
+	Event string    `json:"event"`
+	Date  time.Time `json:"date"`
+}
+
+type entry struct {
+	config *config.ScheduleConfig
+	days   []time.Weekday
+	// Minutes since midnight, from is also used as the time of wake entries
+	from int
+	to   int
+}
+
+// Schedule holds the schedule entries of a host, times are in the local timezone
+type Schedule struct {
+	entries []*entry
+}
+
+func NewSchedule(scheduleConfigs []*config.ScheduleConfig) (*Schedule, error) {
+	schedule := &Schedule{}
+
+	for i, scheduleConfig := range scheduleConfigs {
+		entry, err := newEntry(scheduleConfig)
+
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %v", i, err)
+		}
+
+		schedule.entries = append(schedule.entries, entry)
+	}
+
+	return schedule, nil
+}
+
+func newEntry(scheduleConfig *config.ScheduleConfig) (*entry, error) {
+	entry := &entry{config: scheduleConfig}
+
+	for _, day := range scheduleConfig.Days {
+		weekday, ok := parseWeekday(day)
+
+		if !ok {
+			return nil, fmt.Errorf("unknown day %s", day)
+		}
+
+		entry.days = append(entry.days, weekday)
+	}
+
+	var err error
+
+	switch scheduleConfig.Type {
+	case TypeKeepAwake, TypeForceSleep:
+		if entry.from, err = parseTimeOfDay(scheduleConfig.From); err != nil {
+			return nil, fmt.Errorf("invalid from: %v", err)
+		}
+
+		if entry.to, err = parseTimeOfDay(scheduleConfig.To); err != nil {
+			return nil, fmt.Errorf("invalid to: %v", err)
+		}
+
+		if entry.to <= entry.from {
+			entry.to += 24 * 60
+		}
+	case TypeWake:
+		if entry.from, err = parseTimeOfDay(scheduleConfig.At); err != nil {
+			return nil, fmt.Errorf("invalid at: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown schedule type %s", scheduleConfig.Type)
+	}
+
+	return entry, nil
+}
+
+// parseWeekday accepts the short (mon) or the full (monday) name of the day, in any case
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+
+	if weekday, ok := weekdays[day]; ok {
+		return weekday, true
+	}
+
+	for _, weekday := range weekdays {
+		if day == strings.ToLower(weekday.String()) {
+			return weekday, true
+		}
+	}
+
+	return 0, false
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (entry *entry) appliesOn(date time.Time) bool {
+	return len(entry.days) == 0 || slices.Contains(entry.days, date.Weekday())
+}
+
+// occurrences returns the start and end of the entry for the days around now, in chronological order
+func (entry *entry) occurrences(now time.Time) [][2]time.Time {
+	occurrences := [][2]time.Time{}
+
+	for offset := -1; offset <= 7; offset++ {
+		// Built from the wall clock so that daylight saving changes do not shift the entry
+		day := time.Date(now.Year(), now.Month(), now.Day()+offset, 0, 0, 0, 0, now.Location())
+
+		if !entry.appliesOn(day) {
+			continue
+		}
+
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, entry.from, 0, 0, now.Location())
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, entry.to, 0, 0, now.Location())
+
+		occurrences = append(occurrences, [2]time.Time{start, end})
+	}
+
+	return occurrences
+}
+
+func (entry *entry) activeAt(now time.Time) bool {
+	for _, occurrence := range entry.occurrences(now) {
+		if !now.Before(occurrence[0]) && now.Before(occurrence[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeepAwake returns true if a keep awake window is active
+func (schedule *Schedule) KeepAwake(now time.Time) bool {
+	for _, entry := range schedule.entries {
+		if entry.config.Type == TypeKeepAwake && entry.activeAt(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ForceSleep returns true if a force sleep window is active, with the proxies allowed to wake the host
+func (schedule *Schedule) ForceSleep(now time.Time) (bool, []string) {
+	active := false
+	exceptProxies := []string{}
+
+	for _, entry := range schedule.entries {
+		if entry.config.Type == TypeForceSleep && entry.activeAt(now) {
+			active = true
+			exceptProxies = append(exceptProxies, entry.config.ExceptProxies...)
+		}
+	}
+
+	return active, exceptProxies
+}
+
+// WakeBetween returns true if a wake entry is scheduled after from and until to
+func (schedule *Schedule) WakeBetween(from time.Time, to time.Time) bool {
+	for _, entry := range schedule.entries {
+		if entry.config.Type != TypeWake {
+			continue
+		}
+
+		for _, occurrence := range entry.occurrences(to) {
+			if occurrence[0].After(from) && !occurrence[0].After(to) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Next returns the first transition after now, or nil if the schedule is empty
+func (schedule *Schedule) Next(now time.Time) *Transition {
+	var next *Transition
+
+	candidate := func(entryType string, event string, date time.Time) {
+		if date.After(now) && (next == nil || date.Before(next.Date)) {
+			next = &Transition{Type: entryType, Event: event, Date: date}
+		}
+	}
+
+	for _, entry := range schedule.entries {
+		for _, occurrence := range entry.occurrences(now) {
+			if entry.config.Type == TypeWake {
+				candidate(entry.config.Type, "wake", occurrence[0])
+			} else {
+				candidate(entry.config.Type, "start", occurrence[0])
+				candidate(entry.config.Type, "end", occurrence[1])
+			}
+		}
+	}
+
+	return next
+}
+
+func (schedule *Schedule) IsEmpty() bool {
+	return len(schedule.entries) == 0
+}
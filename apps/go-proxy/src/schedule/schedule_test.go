@@ -0,0 +1,174 @@
+package schedule
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+// 2024-01-01 is a monday
+func date(day int, hour int, minute int) time.Time {
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, time.Local)
+}
+
+func newTestSchedule(t *testing.T, scheduleConfigs ...*config.ScheduleConfig) *Schedule {
+	t.Helper()
+
+	schedule, err := NewSchedule(scheduleConfigs)
+	if err != nil {
+		t.Fatalf("failed to create the schedule: %v", err)
+	}
+
+	return schedule
+}
+
+func TestNewScheduleDays(t *testing.T) {
+	tests := []struct {
+		day      string
+		expected time.Weekday
+		fails    bool
+	}{
+		{day: "mon", expected: time.Monday},
+		{day: "Monday", expected: time.Monday},
+		{day: "SAT", expected: time.Saturday},
+		{day: "sunday", expected: time.Sunday},
+		{day: "monkey", fails: true},
+		{day: "sunflower", fails: true},
+		{day: "mo", fails: true},
+		{day: "", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.day, func(t *testing.T) {
+			schedule, err := NewSchedule([]*config.ScheduleConfig{
+				{Type: TypeKeepAwake, Days: []string{test.day}, From: "09:00", To: "17:00"},
+			})
+
+			if test.fails {
+				if err == nil {
+					t.Errorf("expected an error, got the days %v", schedule.entries[0].days)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if days := schedule.entries[0].days; len(days) != 1 || days[0] != test.expected {
+				t.Errorf("expected %s, got %v", test.expected, days)
+			}
+		})
+	}
+}
+
+func TestWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *config.ScheduleConfig
+		now      time.Time
+		expected bool
+	}{
+		{name: "inside", config: &config.ScheduleConfig{From: "09:00", To: "17:00"}, now: date(1, 9, 0), expected: true},
+		{name: "end excluded", config: &config.ScheduleConfig{From: "09:00", To: "17:00"}, now: date(1, 17, 0)},
+		{name: "before", config: &config.ScheduleConfig{From: "09:00", To: "17:00"}, now: date(1, 8, 59)},
+		{name: "midnight before", config: &config.ScheduleConfig{From: "22:00", To: "06:00"}, now: date(1, 23, 0), expected: true},
+		{name: "midnight after", config: &config.ScheduleConfig{From: "22:00", To: "06:00"}, now: date(2, 5, 59), expected: true},
+		{name: "midnight ended", config: &config.ScheduleConfig{From: "22:00", To: "06:00"}, now: date(2, 6, 0)},
+		{name: "midnight not started", config: &config.ScheduleConfig{From: "22:00", To: "06:00"}, now: date(1, 21, 59)},
+		{name: "day", config: &config.ScheduleConfig{Days: []string{"mon"}, From: "09:00", To: "17:00"}, now: date(1, 10, 0), expected: true},
+		{name: "other day", config: &config.ScheduleConfig{Days: []string{"mon"}, From: "09:00", To: "17:00"}, now: date(2, 10, 0)},
+		// The window starting on friday ends on saturday
+		{name: "day crossing midnight", config: &config.ScheduleConfig{Days: []string{"fri"}, From: "22:00", To: "02:00"}, now: date(6, 1, 0), expected: true},
+		{name: "day crossing midnight other day", config: &config.ScheduleConfig{Days: []string{"fri"}, From: "22:00", To: "02:00"}, now: date(5, 1, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keepAwake := *test.config
+			keepAwake.Type = TypeKeepAwake
+
+			if active := newTestSchedule(t, &keepAwake).KeepAwake(test.now); active != test.expected {
+				t.Errorf("expected the keep awake window to be active: %t, got %t", test.expected, active)
+			}
+
+			forceSleep := *test.config
+			forceSleep.Type = TypeForceSleep
+
+			if active, _ := newTestSchedule(t, &forceSleep).ForceSleep(test.now); active != test.expected {
+				t.Errorf("expected the force sleep window to be active: %t, got %t", test.expected, active)
+			}
+		})
+	}
+}
+
+func TestForceSleepExceptProxies(t *testing.T) {
+	schedule := newTestSchedule(t,
+		&config.ScheduleConfig{Type: TypeForceSleep, From: "22:00", To: "06:00", ExceptProxies: []string{"ssh"}},
+		&config.ScheduleConfig{Type: TypeForceSleep, From: "00:00", To: "04:00", ExceptProxies: []string{"vpn"}},
+		&config.ScheduleConfig{Type: TypeForceSleep, From: "12:00", To: "13:00", ExceptProxies: []string{"web"}},
+	)
+
+	active, exceptProxies := schedule.ForceSleep(date(2, 1, 0))
+
+	if !active || !slices.Equal(exceptProxies, []string{"ssh", "vpn"}) {
+		t.Errorf("expected the proxies of the active windows, got %t %v", active, exceptProxies)
+	}
+
+	active, exceptProxies = schedule.ForceSleep(date(2, 10, 0))
+
+	if active || len(exceptProxies) != 0 {
+		t.Errorf("expected no active window, got %t %v", active, exceptProxies)
+	}
+}
+
+func TestNext(t *testing.T) {
+	window := &config.ScheduleConfig{Type: TypeKeepAwake, From: "22:00", To: "06:00"}
+	wake := &config.ScheduleConfig{Type: TypeWake, Days: []string{"wed"}, At: "07:30"}
+
+	tests := []struct {
+		name     string
+		configs  []*config.ScheduleConfig
+		now      time.Time
+		expected *Transition
+	}{
+		{name: "start", configs: []*config.ScheduleConfig{window}, now: date(1, 12, 0), expected: &Transition{Type: TypeKeepAwake, Event: "start", Date: date(1, 22, 0)}},
+		{name: "end after midnight", configs: []*config.ScheduleConfig{window}, now: date(1, 23, 0), expected: &Transition{Type: TypeKeepAwake, Event: "end", Date: date(2, 6, 0)}},
+		{name: "start excluded", configs: []*config.ScheduleConfig{window}, now: date(1, 22, 0), expected: &Transition{Type: TypeKeepAwake, Event: "end", Date: date(2, 6, 0)}},
+		{name: "wake on a later day", configs: []*config.ScheduleConfig{wake}, now: date(1, 12, 0), expected: &Transition{Type: TypeWake, Event: "wake", Date: date(3, 7, 30)}},
+		{name: "wake next week", configs: []*config.ScheduleConfig{wake}, now: date(3, 8, 0), expected: &Transition{Type: TypeWake, Event: "wake", Date: date(10, 7, 30)}},
+		{name: "earliest entry", configs: []*config.ScheduleConfig{wake, window}, now: date(3, 6, 0), expected: &Transition{Type: TypeWake, Event: "wake", Date: date(3, 7, 30)}},
+		{name: "empty", now: date(1, 12, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := newTestSchedule(t, test.configs...).Next(test.now)
+
+			switch {
+			case test.expected == nil:
+				if next != nil {
+					t.Errorf("expected no transition, got %+v", next)
+				}
+			case next == nil:
+				t.Errorf("expected %+v, got no transition", test.expected)
+			case next.Type != test.expected.Type || next.Event != test.expected.Event || !next.Date.Equal(test.expected.Date):
+				t.Errorf("expected %+v, got %+v", test.expected, next)
+			}
+		})
+	}
+}
+
+func TestWakeBetween(t *testing.T) {
+	schedule := newTestSchedule(t, &config.ScheduleConfig{Type: TypeWake, At: "07:30"})
+
+	if !schedule.WakeBetween(date(1, 7, 0), date(1, 7, 30)) {
+		t.Errorf("expected the wake to be found at the end of the interval")
+	}
+
+	if schedule.WakeBetween(date(1, 7, 30), date(1, 8, 0)) {
+		t.Errorf("expected the wake at the start of the interval to be excluded")
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/auditLog"
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/docker"
+	"mgarnier11.fr/go/go-proxy/host"
+	"mgarnier11.fr/go/go-proxy/hostManager"
+	"mgarnier11.fr/go/go-proxy/hostState"
+	"mgarnier11.fr/go/go-proxy/schedule"
+
+	"github.com/gorilla/mux"
+)
+
+type proxyDto struct {
+	Key        string `json:"key"`
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	ListenPort int    `json:"listenPort"`
+	ServerPort int    `json:"serverPort"`
+	Http       bool   `json:"http"`
+	// Names routed to the proxy when it shares its listen port
+	Hostnames []string `json:"hostnames"`
+}
+
+type autostopDto struct {
+	Enabled      bool `json:"enabled"`
+	MaxAliveTime int  `json:"maxAliveTime"`
+	// Seconds before the host is stopped for inactivity, only set when the host is started
+	RemainingSeconds *int `json:"remainingSeconds,omitempty"`
+}
+
+type proxyActivityDto struct {
+	ProxyName  string    `json:"proxyName"`
+	ClientAddr string    `json:"clientAddr"`
+	Date       time.Time `json:"date"`
+}
+
+type activityDto struct {
+	LastPacketDate time.Time `json:"lastPacketDate"`
+	// Proxy and client of the last activity, the ones keeping the host awake
+	LastProxyName  string              `json:"lastProxyName"`
+	LastClientAddr string              `json:"lastClientAddr"`
+	Proxies        []*proxyActivityDto `json:"proxies"`
+}
+
+type scheduleDto struct {
+	KeepAwake      bool                 `json:"keepAwake"`
+	ForceSleep     bool                 `json:"forceSleep"`
+	NextTransition *schedule.Transition `json:"nextTransition,omitempty"`
+}
+
+type dockerDto struct {
+	// True while the docker events of the host are followed, only when the host is started
+	Following   bool                 `json:"following"`
+	LabelErrors []*docker.LabelError `json:"labelErrors"`
+}
+
+type sleepResultDto struct {
+	Strategy string    `json:"strategy"`
+	Output   string    `json:"output"`
+	Error    string    `json:"error,omitempty"`
+	Date     time.Time `json:"date"`
+}
+
+type hostDto struct {
+	Name           string       `json:"name"`
+	Ip             string       `json:"ip"`
+	MacAddress     string       `json:"macAddress"`
+	State          string       `json:"state"`
+	StateChangedAt time.Time    `json:"stateChangedAt"`
+	Activity       activityDto  `json:"activity"`
+	Autostop       autostopDto  `json:"autostop"`
+	Schedule       *scheduleDto `json:"schedule,omitempty"`
+	DependsOn      []string     `json:"dependsOn"`
+	Docker         dockerDto    `json:"docker"`
+	Proxies        []*proxyDto  `json:"proxies"`
+	// Result of the last sleep request, only set once the host has been stopped
+	LastSleepResult *sleepResultDto `json:"lastSleepResult,omitempty"`
+}
+
+type errorDto struct {
+	Error string `json:"error"`
+}
+
+type autostopRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func newHostDto(host *host.Host) *hostDto {
+	lastActivity := host.GetLastActivity()
+	hostConfig := host.GetConfig()
+
+	dto := &hostDto{
+		Name:           hostConfig.Name,
+		Ip:             hostConfig.Ip,
+		MacAddress:     hostConfig.MacAddress,
+		State:          host.State.String(),
+		StateChangedAt: host.State.ChangedAt(),
+		Activity: activityDto{
+			LastPacketDate: lastActivity.Date,
+			LastProxyName:  lastActivity.ProxyName,
+			LastClientAddr: lastActivity.ClientAddr,
+			Proxies:        []*proxyActivityDto{},
+		},
+		Autostop: autostopDto{
+			Enabled:      hostConfig.Autostop,
+			MaxAliveTime: hostConfig.MaxAliveTime,
+		},
+		DependsOn: append([]string{}, hostConfig.DependsOn...),
+		Proxies:   []*proxyDto{},
+	}
+
+	dto.Docker.Following, dto.Docker.LabelErrors = host.GetDockerStatus()
+
+	if sleepResult := host.GetLastSleepResult(); sleepResult != nil {
+		dto.LastSleepResult = &sleepResultDto{
+			Strategy: sleepResult.Strategy,
+			Output:   sleepResult.Output,
+			Error:    sleepResult.Error,
+			Date:     sleepResult.Date,
+		}
+	}
+
+	if dto.Autostop.Enabled && host.State.Is(hostState.Started) {
+		remainingSeconds := max(int((host.GetInactivityTimeout() - time.Since(lastActivity.Date)).Seconds()), 0)
+		dto.Autostop.RemainingSeconds = &remainingSeconds
+	}
+
+	if hostSchedule := host.GetSchedule(); !hostSchedule.IsEmpty() {
+		now := time.Now()
+		forceSleep, _ := hostSchedule.ForceSleep(now)
+
+		dto.Schedule = &scheduleDto{
+			KeepAwake:      hostSchedule.KeepAwake(now),
+			ForceSleep:     forceSleep,
+			NextTransition: hostSchedule.Next(now),
+		}
+	}
+
+	for _, activity := range host.GetProxiesActivity() {
+		dto.Activity.Proxies = append(dto.Activity.Proxies, &proxyActivityDto{
+			ProxyName:  activity.ProxyName,
+			ClientAddr: activity.ClientAddr,
+			Date:       activity.Date,
+		})
+	}
+
+	for _, proxyConfig := range host.GetProxyConfigs() {
+		dto.Proxies = append(dto.Proxies, &proxyDto{
+			Key:        proxyConfig.Key,
+			Name:       proxyConfig.Name,
+			Protocol:   proxyConfig.Protocol,
+			ListenPort: proxyConfig.ListenPort,
+			ServerPort: proxyConfig.ServerPort,
+			Http:       proxyConfig.Http,
+			Hostnames:  append([]string{}, proxyConfig.Hostnames...),
+		})
+	}
+
+	return dto
+}
+
+func writeJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Errorf("Error writing json response: %v", err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJson(w, status, &errorDto{Error: fmt.Sprintf(format, args...)})
+}
+
+func (s *Server) getHostV2Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostName := mux.Vars(r)["host"]
+		host := hostManager.GetHost(hostName)
+
+		if host == nil {
+			writeJsonError(w, http.StatusNotFound, "host %s not found", hostName)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), hostContextKey, host)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) setupApiV2(router *mux.Router) {
+	apiRouter := router.PathPrefix("/api/v2").Subrouter()
+
+	apiRouter.HandleFunc("/hosts", s.listHostsV2).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/operations/{id}", s.getOperationV2).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/events", s.streamEvents).Methods(http.MethodGet)
+
+	hostRouter := apiRouter.PathPrefix("/hosts/{host}").Subrouter()
+	hostRouter.Use(s.getHostV2Middleware)
+
+	hostRouter.HandleFunc("", s.getHostV2).Methods(http.MethodGet)
+	hostRouter.HandleFunc("/start", s.startHostV2).Methods(http.MethodPost)
+	hostRouter.HandleFunc("/stop", s.stopHostV2).Methods(http.MethodPost)
+	hostRouter.HandleFunc("/autostop", s.setAutostopV2).Methods(http.MethodPut)
+	hostRouter.HandleFunc("/history", s.getHostHistoryV2).Methods(http.MethodGet)
+
+	// The history is also served outside of the versioned api
+	historyRouter := router.PathPrefix("/api/hosts/{host}").Subrouter()
+	historyRouter.Use(s.getHostV2Middleware)
+
+	historyRouter.HandleFunc("/history", s.getHostHistoryV2).Methods(http.MethodGet)
+}
+
+func (s *Server) listHostsV2(w http.ResponseWriter, r *http.Request) {
+	hosts := []*hostDto{}
+
+	for _, host := range hostManager.GetHosts() {
+		hosts = append(hosts, newHostDto(host))
+	}
+
+	slices.SortFunc(hosts, func(a, b *hostDto) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	writeJson(w, http.StatusOK, hosts)
+}
+
+func (s *Server) getHostV2(w http.ResponseWriter, r *http.Request) {
+	host := r.Context().Value(hostContextKey).(*host.Host)
+
+	writeJson(w, http.StatusOK, newHostDto(host))
+}
+
+func (s *Server) startHostV2(w http.ResponseWriter, r *http.Request) {
+	host := r.Context().Value(hostContextKey).(*host.Host)
+
+	switch host.State.Get() {
+	case hostState.Started:
+		writeJson(w, http.StatusOK, newHostDto(host))
+		return
+	case hostState.Starting, hostState.Stopping:
+		writeJsonError(w, http.StatusConflict, "host %s is %s", host.GetConfig().Name, strings.ToLower(host.State.String()))
+		return
+	}
+
+	s.startOperation(w, "start", host, func() error {
+		return host.StartHost(hostState.ApiReason())
+	})
+}
+
+func (s *Server) stopHostV2(w http.ResponseWriter, r *http.Request) {
+	host := r.Context().Value(hostContextKey).(*host.Host)
+
+	switch host.State.Get() {
+	case hostState.Stopped:
+		writeJson(w, http.StatusOK, newHostDto(host))
+		return
+	case hostState.Starting, hostState.Stopping:
+		writeJsonError(w, http.StatusConflict, "host %s is %s", host.GetConfig().Name, strings.ToLower(host.State.String()))
+		return
+	}
+
+	s.startOperation(w, "stop", host, func() error {
+		return host.StopHost(hostState.ApiReason())
+	})
+}
+
+func (s *Server) startOperation(w http.ResponseWriter, operationType string, host *host.Host, action func() error) {
+	operation, err := s.operations.start(operationType, host.GetConfig().Name, action)
+
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "failed to start operation: %v", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/operations/%s", operation.Id))
+	writeJson(w, http.StatusAccepted, operation)
+}
+
+func (s *Server) getOperationV2(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	operation := s.operations.get(id)
+
+	if operation == nil {
+		writeJsonError(w, http.StatusNotFound, "operation %s not found", id)
+		return
+	}
+
+	writeJson(w, http.StatusOK, operation)
+}
+
+func (s *Server) setAutostopV2(w http.ResponseWriter, r *http.Request) {
+	host := r.Context().Value(hostContextKey).(*host.Host)
+
+	request := &autostopRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	if request.Enabled == nil {
+		writeJsonError(w, http.StatusBadRequest, "enabled is required")
+		return
+	}
+
+	if err := host.SetAutostop(*request.Enabled); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, newHostDto(host).Autostop)
+}
+
+// Number of days of history returned when the days parameter is not set
+const defaultHistoryDays = 7
+
+type historyDto struct {
+	Entries []*auditLog.Entry     `json:"entries"`
+	Days    []*auditLog.DayTotals `json:"days"`
+}
+
+func (s *Server) getHostHistoryV2(w http.ResponseWriter, r *http.Request) {
+	host := r.Context().Value(hostContextKey).(*host.Host)
+
+	days := defaultHistoryDays
+
+	if daysParam := r.URL.Query().Get("days"); daysParam != "" {
+		parsedDays, err := strconv.Atoi(daysParam)
+
+		if err != nil || parsedDays < 1 {
+			writeJsonError(w, http.StatusBadRequest, "invalid days: %s", daysParam)
+			return
+		}
+
+		// Older entries are pruned, the totals of these days would be empty
+		if maxDays := max(int(config.Config.AuditRetention/(24*time.Hour)), 1); parsedDays > maxDays {
+			writeJsonError(w, http.StatusBadRequest, "days must not exceed the audit retention of %d days", maxDays)
+			return
+		}
+
+		days = parsedDays
+	}
+
+	now := time.Now()
+	year, month, day := now.Date()
+	since := time.Date(year, month, day-(days-1), 0, 0, 0, 0, now.Location())
+
+	writeJson(w, http.StatusOK, &historyDto{
+		Entries: auditLog.GetHistory(host.GetConfig().Name, since),
+		Days:    auditLog.GetDailyTotals(host.GetConfig().Name, since, now),
+	})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"mgarnier11.fr/go/go-proxy/config"
+	"mgarnier11.fr/go/go-proxy/configValidator"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+const maxConfigSize = 1 << 20
+
+// editableHostFields are the host fields that can be patched, with the type of their value
+var editableHostFields = map[string]func() any{
+	"ip":            func() any { return new(string) },
+	"macAddress":    func() any { return new(string) },
+	"sshUsername":   func() any { return new(string) },
+	"sshPort":       func() any { return new(string) },
+	"autostop":      func() any { return new(bool) },
+	"maxAliveTime":  func() any { return new(int) },
+	"startTimeout":  func() any { return new(int) },
+	"stopTimeout":   func() any { return new(int) },
+	"wakeOnStartup": func() any { return new(bool) },
+}
+
+type configValidationDto struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+}
+
+// validateConfig checks the yaml config sent in the body without applying it
+func (s *Server) validateConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "failed to read body: %v", err)
+		return
+	}
+
+	result := &configValidationDto{Errors: []string{}}
+
+	configFile, err := config.ParseConfigFile(body)
+
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	} else {
+		for _, err := range configValidator.Validate(configFile) {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+
+	result.Valid = len(result.Errors) == 0
+
+	if !result.Valid {
+		writeJson(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+func (s *Server) setupConfigApi(router *mux.Router) {
+	configRouter := router.PathPrefix("/api/config").Subrouter()
+
+	configRouter.HandleFunc("/validate", s.validateConfig).Methods(http.MethodPost)
+	configRouter.HandleFunc("/hosts", s.addConfigHost).Methods(http.MethodPost)
+	configRouter.HandleFunc("/hosts/{host}", s.patchConfigHost).Methods(http.MethodPatch)
+	configRouter.HandleFunc("/hosts/{host}", s.removeConfigHost).Methods(http.MethodDelete)
+	configRouter.HandleFunc("/hosts/{host}/proxies", s.addConfigProxy).Methods(http.MethodPost)
+	configRouter.HandleFunc("/hosts/{host}/proxies/{listenPort}", s.removeConfigProxy).Methods(http.MethodDelete)
+}
+
+// writeConfigEditError writes the error of a config edit with the matching status
+func writeConfigEditError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, config.ErrHostNotFound), errors.Is(err, config.ErrProxyNotFound):
+		writeJsonError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, config.ErrHostExists):
+		writeJsonError(w, http.StatusConflict, "%v", err)
+	case errors.Is(err, config.ErrInvalidConfig):
+		writeJsonError(w, http.StatusUnprocessableEntity, "%v", err)
+	default:
+		writeJsonError(w, http.StatusInternalServerError, "failed to edit config: %v", err)
+	}
+}
+
+// decodeConfigBody decodes the yaml or json body into out
+func decodeConfigBody(r *http.Request, out any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(body, out)
+}
+
+// addConfigHost adds the host sent in the body to the config file
+func (s *Server) addConfigHost(w http.ResponseWriter, r *http.Request) {
+	hostConfig := &config.HostConfig{}
+
+	if err := decodeConfigBody(r, hostConfig); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	if hostConfig.Name == "" {
+		writeJsonError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if err := config.AddHost(hostConfig); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchConfigHost sets the fields sent in the body on the host of the config file
+func (s *Server) patchConfigHost(w http.ResponseWriter, r *http.Request) {
+	request := map[string]json.RawMessage{}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxConfigSize)).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	if len(request) == 0 {
+		writeJsonError(w, http.StatusBadRequest, "no field to update")
+		return
+	}
+
+	fields := map[string]any{}
+
+	for field, rawValue := range request {
+		newValue, ok := editableHostFields[field]
+
+		if !ok {
+			writeJsonError(w, http.StatusBadRequest, "field %s can not be edited", field)
+			return
+		}
+
+		value := newValue()
+
+		if err := json.Unmarshal(rawValue, value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid value for %s: %v", field, err)
+			return
+		}
+
+		fields[field] = value
+	}
+
+	if err := config.SetHostFields(mux.Vars(r)["host"], fields); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeConfigHost removes the host from the config file
+func (s *Server) removeConfigHost(w http.ResponseWriter, r *http.Request) {
+	if err := config.RemoveHost(mux.Vars(r)["host"]); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addConfigProxy adds the static proxy sent in the body to the host of the config file
+func (s *Server) addConfigProxy(w http.ResponseWriter, r *http.Request) {
+	proxyConfig := &config.ProxyConfig{}
+
+	if err := decodeConfigBody(r, proxyConfig); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	if err := config.AddProxy(mux.Vars(r)["host"], proxyConfig); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// removeConfigProxy removes the static proxy listening on the port from the host of the config file, the protocol defaults to tcp
+func (s *Server) removeConfigProxy(w http.ResponseWriter, r *http.Request) {
+	listenPort, err := strconv.Atoi(mux.Vars(r)["listenPort"])
+
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid listen port: %v", err)
+		return
+	}
+
+	protocol := r.URL.Query().Get("protocol")
+
+	if protocol == "" {
+		protocol = config.ProtocolTCP
+	}
+
+	if err := config.RemoveProxy(mux.Vars(r)["host"], listenPort, protocol); err != nil {
+		writeConfigEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
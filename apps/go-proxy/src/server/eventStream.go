@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mgarnier11.fr/go/go-proxy/events"
+)
+
+const eventStreamHeartbeat = 15 * time.Second
+
+// streamEvents sends the published events as server-sent events, they can be filtered with the host and type query parameters
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		writeJsonError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	hostFilter := r.URL.Query().Get("host")
+	typeFilter := r.URL.Query().Get("type")
+
+	eventChan, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case event, ok := <-eventChan:
+			if !ok {
+				return
+			}
+
+			if hostFilter != "" && !strings.EqualFold(event.Host, hostFilter) {
+				continue
+			}
+
+			if typeFilter != "" && !strings.HasPrefix(string(event.Type), typeFilter) {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+
+			if err != nil {
+				log.Errorf("Error marshalling event: %v", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
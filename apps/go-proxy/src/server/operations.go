@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/utils"
+)
+
+type OperationStatus string
+
+const (
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+
+	operationRetention = time.Hour
+)
+
+// Operation tracks a long running action started from the api
+type Operation struct {
+	Id         string          `json:"id"`
+	Type       string          `json:"type"`
+	Host       string          `json:"host"`
+	Status     OperationStatus `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+}
+
+type operationStore struct {
+	operations map[string]*Operation
+	mutex      sync.Mutex
+}
+
+func newOperationStore() *operationStore {
+	return &operationStore{
+		operations: make(map[string]*Operation),
+	}
+}
+
+// start runs the action in the background and returns the operation tracking it
+func (store *operationStore) start(operationType string, hostName string, action func() error) (*Operation, error) {
+	id, err := utils.GenerateRandomString(16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	operation := &Operation{
+		Id:        id,
+		Type:      operationType,
+		Host:      hostName,
+		Status:    OperationRunning,
+		CreatedAt: time.Now(),
+	}
+
+	store.mutex.Lock()
+	store.cleanup()
+	store.operations[id] = operation
+	snapshot := *operation
+	store.mutex.Unlock()
+
+	go func() {
+		err := action()
+
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		finishedAt := time.Now()
+		operation.FinishedAt = &finishedAt
+
+		if err != nil {
+			operation.Status = OperationFailed
+			operation.Error = err.Error()
+		} else {
+			operation.Status = OperationSucceeded
+		}
+	}()
+
+	return &snapshot, nil
+}
+
+// get returns a copy of the operation, or nil if it does not exist
+func (store *operationStore) get(id string) *Operation {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	operation, exists := store.operations[id]
+
+	if !exists {
+		return nil
+	}
+
+	snapshot := *operation
+
+	return &snapshot
+}
+
+// cleanup removes the finished operations older than the retention, must be called with the mutex held
+func (store *operationStore) cleanup() {
+	for id, operation := range store.operations {
+		if operation.FinishedAt != nil && time.Since(*operation.FinishedAt) > operationRetention {
+			delete(store.operations, id)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -11,7 +12,9 @@ import (
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"mgarnier11.fr/go/libs/httputils"
 	"mgarnier11.fr/go/libs/logger"
 	"mgarnier11.fr/go/libs/version"
 )
@@ -21,14 +24,18 @@ type contextKey string
 const hostContextKey contextKey = "host"
 
 type Server struct {
-	port int
+	port       int
+	operations *operationStore
+	httpServer *http.Server
 }
 
 var log *logger.Logger
 
 func NewServer(port int) *Server {
 	return &Server{
-		port: port,
+		port:       port,
+		operations: newOperationStore(),
+		httpServer: &http.Server{Addr: fmt.Sprintf(":%d", port)},
 	}
 }
 
@@ -67,52 +74,73 @@ func (s *Server) Start() error {
 
 	version.SetupVersionRoute(router)
 
+	router.Handle("/metrics", promhttp.Handler())
+
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Go Proxy Server"))
 	})
 
+	s.setupApiV2(router)
+
+	s.setupConfigApi(router)
+
 	controlRouter := router.PathPrefix("/control/{host}").Subrouter()
 	controlRouter.Use(s.getHostMiddleware)
 
 	controlRouter.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		host.StartHost("Api")
+		host.StartHost(hostState.ApiReason())
 
-		if host.State == hostState.Started {
-			w.Write([]byte(fmt.Sprintf("Host %s has successfully started", host.Config.Name)))
+		if host.State.Get() == hostState.Started {
+			w.Write([]byte(fmt.Sprintf("Host %s has successfully started", host.GetConfig().Name)))
 		} else {
-			w.Write([]byte(fmt.Sprintf("Host %s failed to start, check logs", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s failed to start, check logs", host.GetConfig().Name)))
 		}
 	})
 
 	controlRouter.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		host.StopHost()
+		err := host.StopHost(hostState.ApiReason())
 
-		if host.State == hostState.Stopped {
-			w.Write([]byte(fmt.Sprintf("Host %s has successfully stopped", host.Config.Name)))
+		if host.State.Get() == hostState.Stopped {
+			w.Write([]byte(fmt.Sprintf("Host %s has successfully stopped", host.GetConfig().Name)))
+		} else if err != nil {
+			w.Write([]byte(fmt.Sprintf("Host %s failed to stop: %v", host.GetConfig().Name, err)))
 		} else {
-			w.Write([]byte(fmt.Sprintf("Host %s failed to stop, check logs", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s failed to stop, check logs", host.GetConfig().Name)))
 		}
 	})
 
+	controlRouter.HandleFunc("/sleep-result", func(w http.ResponseWriter, r *http.Request) {
+		host := r.Context().Value(hostContextKey).(*host.Host)
+
+		sleepResult := host.GetLastSleepResult()
+
+		if sleepResult == nil {
+			http.Error(w, fmt.Sprintf("Host %s has not been stopped yet", host.GetConfig().Name), http.StatusNotFound)
+			return
+		}
+
+		httputils.WriteYamlResponse(w, sleepResult)
+	})
+
 	controlRouter.HandleFunc("/start-stop", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		if host.State == hostState.Started {
-			host.StopHost()
-		} else if host.State == hostState.Stopped {
-			host.StartHost("Api")
+		if state := host.State.Get(); state == hostState.Started {
+			host.StopHost(hostState.ApiReason())
+		} else if state == hostState.Stopped {
+			host.StartHost(hostState.ApiReason())
 		}
 
-		if host.State == hostState.Started {
-			w.Write([]byte(fmt.Sprintf("Host %s has successfully started", host.Config.Name)))
-		} else if host.State == hostState.Stopped {
-			w.Write([]byte(fmt.Sprintf("Host %s has successfully stopped", host.Config.Name)))
+		if state := host.State.Get(); state == hostState.Started {
+			w.Write([]byte(fmt.Sprintf("Host %s has successfully started", host.GetConfig().Name)))
+		} else if state == hostState.Stopped {
+			w.Write([]byte(fmt.Sprintf("Host %s has successfully stopped", host.GetConfig().Name)))
 		} else {
-			w.Write([]byte(fmt.Sprintf("Host %s failed to start/stop, check logs", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s failed to start/stop, check logs", host.GetConfig().Name)))
 		}
 
 	})
@@ -120,36 +148,56 @@ func (s *Server) Start() error {
 	controlRouter.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		w.WriteHeader(210 + int(host.State))
-		w.Write([]byte(fmt.Sprintf("Host %s is %s", host.Config.Name, host.State.String())))
+		w.WriteHeader(210 + int(host.State.Get()))
+		w.Write([]byte(fmt.Sprintf("Host %s is %s", host.GetConfig().Name, host.State.String())))
 	})
 
 	controlRouter.HandleFunc("/autostop-toggle", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		host.Config.Autostop = !host.Config.Autostop
-		host.Config.Save()
+		if err := host.SetAutostop(!host.IsAutostopEnabled()); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to toggle autostop of host %s: %v", host.GetConfig().Name, err), http.StatusInternalServerError)
+			return
+		}
 
-		if host.Config.Autostop {
-			w.Write([]byte(fmt.Sprintf("Host %s autostop enabled", host.Config.Name)))
+		if host.IsAutostopEnabled() {
+			w.Write([]byte(fmt.Sprintf("Host %s autostop enabled", host.GetConfig().Name)))
 		} else {
-			w.Write([]byte(fmt.Sprintf("Host %s autostop disabled", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s autostop disabled", host.GetConfig().Name)))
 		}
 	})
 
 	controlRouter.HandleFunc("/autostop-status", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Context().Value(hostContextKey).(*host.Host)
 
-		if host.Config.Autostop {
+		if host.IsAutostopEnabled() {
 			w.WriteHeader(215)
-			w.Write([]byte(fmt.Sprintf("Host %s autostop enabled", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s autostop enabled", host.GetConfig().Name)))
 		} else {
 			w.WriteHeader(216)
-			w.Write([]byte(fmt.Sprintf("Host %s autostop disabled", host.Config.Name)))
+			w.Write([]byte(fmt.Sprintf("Host %s autostop disabled", host.GetConfig().Name)))
 		}
 	})
 
+	s.httpServer.Handler = router
+
 	log.Infof("Starting server on port %d", s.port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), router)
+	err := s.httpServer.ListenAndServe()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown stops the server, the requests still running when the context is done are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Infof("Stopping server")
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return s.httpServer.Close()
+	}
 
+	return nil
 }
@@ -0,0 +1,132 @@
+package stateStore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"mgarnier11.fr/go/libs/logger"
+
+	"mgarnier11.fr/go/go-proxy/config"
+)
+
+const flushInterval = 10 * time.Second
+
+// HostRecord is the runtime state of a host kept across restarts. The autostop toggles are not kept here: they are
+// written to the config file, which survives restarts too, so that no runtime override hides the edits of the file
+type HostRecord struct {
+	LastPacketDate time.Time `json:"lastPacketDate"`
+	LastProxyName  string    `json:"lastProxyName"`
+	LastClientAddr string    `json:"lastClientAddr"`
+	LastState      string    `json:"lastState"`
+	StateChangedAt time.Time `json:"stateChangedAt"`
+	// Proxies of the containers found the last time the host was started
+	DockerProxies []*config.ProxyConfig `json:"dockerProxies,omitempty"`
+}
+
+var (
+	records  map[string]*HostRecord
+	dirty    = false
+	loadOnce sync.Once
+	mutex    sync.Mutex
+)
+
+func load() {
+	records = make(map[string]*HostRecord)
+
+	data, err := os.ReadFile(config.Config.StateFilePath)
+
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Infof("No state file found at %s, starting with an empty state", config.Config.StateFilePath)
+	} else if err != nil {
+		logger.Errorf("Failed to read state file: %v", err)
+	} else if err := json.Unmarshal(data, &records); err != nil {
+		logger.Errorf("Failed to parse state file, starting with an empty state: %v", err)
+		records = make(map[string]*HostRecord)
+	}
+
+	go flushLoop()
+}
+
+func flushLoop() {
+	for range time.Tick(flushInterval) {
+		if err := Flush(); err != nil {
+			logger.Errorf("Failed to save state file: %v", err)
+		}
+	}
+}
+
+// GetHost returns a copy of the record of the host, or nil if the host has never been saved
+func GetHost(name string) *HostRecord {
+	loadOnce.Do(load)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	record, exists := records[strings.ToUpper(name)]
+
+	if !exists {
+		return nil
+	}
+
+	recordCopy := *record
+
+	return &recordCopy
+}
+
+// UpdateHost applies the update to the record of the host, the store is written to disk in the background
+func UpdateHost(name string, update func(record *HostRecord)) {
+	loadOnce.Do(load)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	hostKey := strings.ToUpper(name)
+
+	record, exists := records[hostKey]
+
+	if !exists {
+		record = &HostRecord{}
+		records[hostKey] = record
+	}
+
+	update(record)
+	dirty = true
+}
+
+// Flush writes the store to disk if it changed since the last write
+func Flush() error {
+	loadOnce.Do(load)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	filePath := config.Config.StateFilePath
+
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	if err := config.WriteFileAtomic(filePath, data); err != nil {
+		return err
+	}
+
+	dirty = false
+
+	return nil
+}